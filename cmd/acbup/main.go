@@ -2,10 +2,18 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/alexcb/acbup/pack"
 	"github.com/alexcb/acbup/util/termutil"
@@ -14,12 +22,77 @@ import (
 )
 
 type flags struct {
-	Recover bool   `long:"recover" description:"attempt to fix corrupted data"`
-	Restore bool   `long:"restore-local-file-from-backup" description:"overwrites local file from backed up copy"`
-	Verify  bool   `long:"verify" description:"verify backup integrity"`
-	List    bool   `short:"l" long:"list" description:"list contents of backup"`
-	Config  string `short:"c" long:"config" description:"config file"`
-	Help    bool   `short:"h" long:"help" description:"display this help"`
+	Init    bool `long:"init" description:"create a new backup at the configured dst"`
+	Recover bool `long:"recover" description:"attempt to fix corrupted data"`
+	// RepairFrom can be given several times
+	RepairFrom []string `long:"repair-from" value-name:"DST" description:"with --recover or a restore, fetch objects which can't be recovered locally from this pack (e.g. a mirror)"`
+	Restore    bool     `long:"restore-local-file-from-backup" description:"overwrites local file from backed up copy"`
+	// RestoreTree restores whole trees (selected by the path prefixes given as args) under Target
+	RestoreTree bool     `long:"restore" description:"restore the files of a snapshot (optionally only those under the given paths) under --target"`
+	Target      string   `long:"target" value-name:"DIR" description:"with --restore, the dir to restore files under"`
+	Include     []string `long:"include" value-name:"GLOB" description:"with --restore, only restore files matching this glob (may be repeated)"`
+	Exclude     []string `long:"exclude" value-name:"GLOB" description:"with --restore, skip files matching this glob (may be repeated)"`
+	Snapshot    string   `long:"snapshot" value-name:"ID" description:"with --restore, the snapshot to restore from (default: the current one)"`
+	OnConflict  string   `long:"on-conflict" default:"overwrite" choice:"overwrite" choice:"skip" choice:"keep-both" choice:"if-newer" choice:"ask" description:"with --restore, what to do with existing files which differ from the backed up ones"`
+	DryRun      bool     `short:"n" long:"dry-run" description:"with --restore, only report which files would be created, overwritten, or left alone"`
+	Verify      bool     `long:"verify" description:"verify backup integrity"`
+	Rebuild     bool     `long:"rebuild-index" description:"reconstruct lost refs by scanning all backed up data"`
+	Upgrade     bool     `long:"upgrade" description:"convert a backup created by an older version to the current format"`
+	List        bool     `short:"l" long:"list" description:"list contents of backup"`
+	Config      string   `short:"c" long:"config" description:"config file"`
+	Help        bool     `short:"h" long:"help" description:"display this help"`
+}
+
+type serveFlags struct {
+	Listen     string `long:"listen" default:":8437" description:"address to listen on"`
+	TokenFile  string `long:"token-file" description:"file containing the token which clients must send (via ACBUP_TOKEN)"`
+	TLSCert    string `long:"tls-cert" description:"certificate file; serves https when given with --tls-key"`
+	TLSKey     string `long:"tls-key" description:"private key file for --tls-cert"`
+	AppendOnly bool   `long:"append-only" description:"refuse requests which would delete or rewrite backup history"`
+	Help       bool   `short:"h" long:"help" description:"display this help"`
+}
+
+type syncFlags struct {
+	From   string `long:"from" description:"pack to copy snapshots from"`
+	To     string `long:"to" description:"pack to bring up to date"`
+	DryRun bool   `short:"n" long:"dry-run" description:"only report what would be transferred"`
+	Help   bool   `short:"h" long:"help" description:"display this help"`
+}
+
+type bundleCreateFlags struct {
+	From  string `long:"from" description:"pack to bundle snapshots from"`
+	Since string `long:"since" value-name:"SNAPSHOT" description:"only bundle snapshots newer than this one, which the receiving pack must already have"`
+	Help  bool   `short:"h" long:"help" description:"display this help"`
+}
+
+type bundleApplyFlags struct {
+	To   string `long:"to" description:"pack to import the bundle into"`
+	Help bool   `short:"h" long:"help" description:"display this help"`
+}
+
+type exportFlags struct {
+	From     string `long:"from" description:"pack to export from"`
+	Snapshot string `long:"snapshot" value-name:"ID" description:"snapshot to export (default: the current one)"`
+	Format   string `long:"format" default:"tar" choice:"tar" choice:"tar.gz" choice:"zip" description:"archive format"`
+	Prefix   string `long:"prefix" value-name:"PATH" description:"only export the file or dir at this path"`
+	Help     bool   `short:"h" long:"help" description:"display this help"`
+}
+
+type catFlags struct {
+	From     string `long:"from" description:"pack to read from"`
+	Snapshot string `long:"snapshot" value-name:"ID" description:"snapshot to read the file from (default: the current one)"`
+	Help     bool   `short:"h" long:"help" description:"display this help"`
+}
+
+type catObjectFlags struct {
+	From string `long:"from" description:"pack to read from"`
+	Help bool   `short:"h" long:"help" description:"display this help"`
+}
+
+type importTarFlags struct {
+	To    string `long:"to" description:"pack to import into"`
+	Alias string `long:"alias" value-name:"PATH" description:"path under which the archive's files are recorded"`
+	Help  bool   `short:"h" long:"help" description:"display this help"`
 }
 
 func die(msg string, args ...interface{}) {
@@ -27,11 +100,28 @@ func die(msg string, args ...interface{}) {
 	os.Exit(1)
 }
 
+// destination is a pack which is backed up to; a config may list several, each of which gets its own snapshot
+type destination struct {
+	// dst is a local directory or an s3://, sftp://, or http(s):// url; its backend is only opened once it's used,
+	// so that one which can't be reached doesn't stop the others from being used
+	dst    string
+	packID string
+}
+
 type config struct {
 	src   string
 	alias string
-	dst   string
+	dsts  []*destination
 	par   int
+
+	// appendOnly creates the pack append-only at --init, and otherwise requires that it is
+	appendOnly bool
+
+	checkpointFiles   int
+	checkpointMinutes int
+
+	onChange        pack.ChangePolicy
+	onChangeRetries int
 }
 
 func readConfig(path string) (*config, error) {
@@ -43,8 +133,14 @@ func readConfig(path string) (*config, error) {
 
 	var src string
 	var alias string
-	var dst string
+	var dsts []string
+	var packIDs []string
+	appendOnly := false
 	par := 2
+	checkpointFiles := 1000
+	checkpointMinutes := 10
+	onChange := pack.ChangeRetry
+	onChangeRetries := 3
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
@@ -66,12 +162,40 @@ func readConfig(path string) (*config, error) {
 		case "alias":
 			alias = val
 		case "dst":
-			dst = val
+			dsts = append(dsts, val)
+		case "pack_id":
+			// pack_id entries belong to the dst entries in the order they're given
+			packIDs = append(packIDs, val)
+		case "append_only":
+			appendOnly, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
 		case "par":
 			par, err = strconv.Atoi(val)
 			if err != nil {
 				return nil, err
 			}
+		case "checkpoint_files":
+			checkpointFiles, err = strconv.Atoi(val)
+			if err != nil {
+				return nil, err
+			}
+		case "checkpoint_minutes":
+			checkpointMinutes, err = strconv.Atoi(val)
+			if err != nil {
+				return nil, err
+			}
+		case "on_change":
+			onChange, err = pack.ParseChangePolicy(val)
+			if err != nil {
+				return nil, err
+			}
+		case "on_change_retries":
+			onChangeRetries, err = strconv.Atoi(val)
+			if err != nil {
+				return nil, err
+			}
 
 		default:
 			return nil, fmt.Errorf("unsupported key: %q", key)
@@ -81,9 +205,20 @@ func readConfig(path string) (*config, error) {
 	if src == "" {
 		return nil, fmt.Errorf("src not defined")
 	}
-	if dst == "" {
+	if len(dsts) == 0 {
 		return nil, fmt.Errorf("dst not defined")
 	}
+	if len(packIDs) > len(dsts) {
+		return nil, fmt.Errorf("there are more pack_id entries than dst entries")
+	}
+	var destinations []*destination
+	for i, dst := range dsts {
+		d := &destination{dst: dst}
+		if i < len(packIDs) {
+			d.packID = packIDs[i]
+		}
+		destinations = append(destinations, d)
+	}
 	if alias == "" {
 		alias = src
 	} else {
@@ -102,9 +237,17 @@ func readConfig(path string) (*config, error) {
 	}
 	cfg := &config{
 		src:   src,
-		dst:   dst,
+		dsts:  destinations,
 		alias: alias,
 		par:   par,
+
+		appendOnly: appendOnly,
+
+		checkpointFiles:   checkpointFiles,
+		checkpointMinutes: checkpointMinutes,
+
+		onChange:        onChange,
+		onChangeRetries: onChangeRetries,
 	}
 	return cfg, nil
 }
@@ -114,7 +257,7 @@ func main() {
 	if len(os.Args) > 0 {
 		progName = os.Args[0]
 	}
-	usage := fmt.Sprintf("%s [options]", progName)
+	usage := fmt.Sprintf("%s [options]\n  %s serve [serve-options] <dst>\n  %s sync [sync-options] --from=<dst> --to=<dst>\n  %s bundle create [--since=<snapshot>] --from=<dst> <file>\n  %s bundle apply --to=<dst> <file>\n  %s export [export-options] --from=<dst> > <archive>\n  %s import-tar --to=<dst> --alias=<path> <archive>\n  %s cat [--snapshot=<id>] --from=<dst> <path>\n  %s cat-object --from=<dst> <sha1>", progName, progName, progName, progName, progName, progName, progName, progName, progName)
 
 	flags := flags{}
 	parser := goflags.NewNamedParser("", goflags.PrintErrors|goflags.PassDoubleDash|goflags.PassAfterNonOption)
@@ -128,6 +271,35 @@ func main() {
 		os.Exit(0)
 	}
 
+	if len(args) > 0 && args[0] == "serve" {
+		serve(progName, args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "sync" {
+		sync(progName, args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "bundle" {
+		bundle(progName, args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "export" {
+		export(progName, args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "import-tar" {
+		importTar(progName, args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "cat" {
+		cat(progName, args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "cat-object" {
+		catObject(progName, args[1:])
+		return
+	}
+
 	if flags.Config == "" {
 		die("no config file was given\n")
 	}
@@ -138,34 +310,210 @@ func main() {
 	}
 
 	interactive := termutil.IsTTY()
+	ctx := interruptContext()
+	packOptions := func(d *destination, readOnly bool) pack.Options {
+		return pack.Options{
+			ReadOnly:           readOnly,
+			Interactive:        interactive,
+			ParityBits:         cfg.par,
+			PackID:             d.packID,
+			AppendOnly:         cfg.appendOnly,
+			CheckpointFiles:    cfg.checkpointFiles,
+			CheckpointInterval: time.Duration(cfg.checkpointMinutes) * time.Minute,
+			OnChange:           cfg.onChange,
+			ChangeRetries:      cfg.onChangeRetries,
+		}
+	}
+
+	if flags.Init {
+		if len(args) != 0 {
+			die("unhandled args: %v", args)
+		}
+		forEachDst(cfg, func(d *destination, b pack.Backend) error {
+			id, err := pack.Init(b, cfg.par, cfg.appendOnly)
+			if err != nil {
+				return fmt.Errorf("failed to init %s: %s", d.dst, err)
+			}
+			fmt.Printf("created backup %s with pack_id=%s\n", d.dst, id)
+			return nil
+		})
+		return
+	}
+
+	if flags.Rebuild {
+		if len(args) != 0 {
+			die("unhandled args: %v", args)
+		}
+		forEachDst(cfg, func(d *destination, b pack.Backend) error {
+			numSnapshots, numOrphans, err := pack.RebuildIndex(ctx, b, cfg.par)
+			if err != nil {
+				return fmt.Errorf("rebuild-index of %s failed: %s", d.dst, err)
+			}
+			fmt.Printf("rebuild-index of %s done: found %d snapshot(s) and %d orphaned object(s)\n", d.dst, numSnapshots, numOrphans)
+			return nil
+		})
+		return
+	}
+
+	if flags.Upgrade {
+		if len(args) != 0 {
+			die("unhandled args: %v", args)
+		}
+		forEachDst(cfg, func(d *destination, b pack.Backend) error {
+			err := pack.Upgrade(b, cfg.par)
+			if err != nil {
+				return fmt.Errorf("upgrade of %s failed: %s", d.dst, err)
+			}
+			fmt.Printf("upgrade of %s done\n", d.dst)
+			return nil
+		})
+		return
+	}
 
 	if flags.Verify {
 		if len(args) != 0 {
 			die("unhandled args: %v", args)
 		}
+		forEachDst(cfg, func(d *destination, b pack.Backend) error {
+			p, err := pack.New(b, packOptions(d, true))
+			if err != nil {
+				return fmt.Errorf("failed to create new Pack: %s", err)
+			}
+			ok, err := p.Verify(ctx)
+			p.Close()
+			if err != nil {
+				return fmt.Errorf("verification of %s failed: %s", d.dst, err)
+			}
+			if !ok {
+				return fmt.Errorf("verification of %s failed", d.dst)
+			}
+			fmt.Printf("verification of %s passed\n", d.dst)
+			return nil
+		})
+		return
+	}
+
+	if len(flags.RepairFrom) > 0 && !flags.Recover && !flags.Restore && !flags.RestoreTree {
+		die("--repair-from can only be used with --recover or a restore\n")
+	}
+	var repairFrom []pack.Backend
+	for _, dst := range flags.RepairFrom {
+		b, err := pack.OpenBackend(dst)
+		if err != nil {
+			die("failed to open %s: %s\n", dst, err)
+		}
+		repairFrom = append(repairFrom, b)
+	}
+
+	// listing and restoring read from the first dst
+	primary := cfg.dsts[0]
+	openPrimary := func() pack.Backend {
+		b, err := pack.OpenBackend(primary.dst)
+		if err != nil {
+			die("failed to open %s: %s\n", primary.dst, err)
+		}
+		return b
+	}
+
+	// restores never write to the pack (so they work on a write-protected one); an object with no intact copy left in
+	// it is read from the other dsts (those which can be opened), and then from any --repair-from packs
+	restoreOptions := func() pack.Options {
+		opts := packOptions(primary, true)
+		for _, d := range cfg.dsts[1:] {
+			b, err := pack.OpenBackend(d.dst)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: failed to open %s, which won't be read from: %s\n", d.dst, err)
+				continue
+			}
+			opts.RepairFrom = append(opts.RepairFrom, b)
+		}
+		opts.RepairFrom = append(opts.RepairFrom, repairFrom...)
+		return opts
+	}
+
+	if flags.List {
+		if len(args) != 0 {
+			die("unhandled args: %v", args)
+		}
 
-		p, err := pack.New(cfg.dst, true, interactive, cfg.par)
+		b := openPrimary()
+		p, err := pack.New(b, packOptions(primary, true))
 		if err != nil {
 			die("failed to create new Pack: %s\n", err)
 		}
 
-		ok := p.Verify()
-		if !ok {
-			die("verification of %s failed\n", cfg.dst)
+		files, err := p.List()
+		p.Close()
+		pack.CloseBackend(b)
+		if err != nil {
+			die("failed to list contents of backup %s: %s\n", primary.dst, err)
+		}
+		for _, f := range files {
+			fmt.Println(f)
 		}
-		fmt.Printf("verification of %s passed\n", cfg.dst)
 		return
 	}
 
-	p, err := pack.New(cfg.dst, false, interactive, cfg.par)
-	if err != nil {
-		die("failed to create new Pack: %s\n", err)
+	if !flags.RestoreTree && (flags.DryRun || flags.OnConflict != pack.ConflictOverwrite.String()) {
+		die("--on-conflict and --dry-run can only be used with --restore\n")
+	}
+
+	if flags.RestoreTree {
+		if flags.Target == "" {
+			die("--restore requires --target\n")
+		}
+		onConflict, err := pack.ParseConflictPolicy(flags.OnConflict)
+		if err != nil {
+			die("%s\n", err)
+		}
+		b := openPrimary()
+		opts := restoreOptions()
+		p, err := pack.New(b, opts)
+		if err != nil {
+			die("failed to create new Pack: %s\n", err)
+		}
+		var prefixes []string
+		for _, path := range args {
+			if strings.HasPrefix(path, cfg.src) {
+				path = cfg.alias + path[len(cfg.src):]
+			}
+			prefixes = append(prefixes, path)
+		}
+		stats, err := p.RestoreTree(ctx, pack.RestoreOptions{
+			Snapshot:   flags.Snapshot,
+			Target:     flags.Target,
+			Prefixes:   prefixes,
+			Include:    flags.Include,
+			Exclude:    flags.Exclude,
+			OnConflict: onConflict,
+			DryRun:     flags.DryRun,
+		})
+		p.Close()
+		closeBackends(append([]pack.Backend{b}, opts.RepairFrom...))
+		if err != nil {
+			die("restore from %s failed: %s\n", primary.dst, err)
+		}
+		if flags.DryRun {
+			fmt.Printf("would restore %d file(s), %d byte(s) from %s to %s (overwriting %d); %d file(s) already match, %d would be left alone\n", stats.Files, stats.Bytes, primary.dst, flags.Target, stats.Overwritten, stats.Unchanged, stats.Skipped)
+		} else {
+			fmt.Printf("restored %d file(s), %d byte(s) from %s to %s (overwriting %d); %d file(s) already matched, %d were left alone\n", stats.Files, stats.Bytes, primary.dst, flags.Target, stats.Overwritten, stats.Unchanged, stats.Skipped)
+		}
+		if stats.Failed > 0 {
+			die("%d file(s) could not be restored\n", stats.Failed)
+		}
+		return
 	}
 
 	if flags.Restore {
 		if len(args) == 0 {
 			die("restore takes one or more local filepaths to restore")
 		}
+		b := openPrimary()
+		opts := restoreOptions()
+		p, err := pack.New(b, opts)
+		if err != nil {
+			die("failed to create new Pack: %s\n", err)
+		}
 		for _, path := range args {
 			var aliasPath string
 			if strings.HasPrefix(path, cfg.src) {
@@ -175,12 +523,18 @@ func main() {
 				path = cfg.src + path[len(cfg.alias):]
 			}
 
-			err := p.Restore(aliasPath, path)
+			err := p.Restore(ctx, aliasPath, path)
 			if err != nil {
+				p.Abort()
 				die("restore-local-file-from-backup of %s failed: %s\n", path, err)
 			}
 			fmt.Printf("restore-local-file-from-backup of %s done\n", path)
 		}
+		err = p.Close()
+		closeBackends(append([]pack.Backend{b}, opts.RepairFrom...))
+		if err != nil {
+			die("failed to close pack %s: %s\n", primary.dst, err)
+		}
 		return
 	}
 
@@ -189,39 +543,548 @@ func main() {
 	}
 
 	if flags.Recover {
-		// TODO recovery mode should only perform recovery under p.Recover() and never under pack.New()
-		// in fact we should move this logic into a function (rather than method): pack.Recover(dst)
-		numOK, numRecovered, numFailed, err := p.Recover()
+		defer closeBackends(repairFrom)
+		forEachDst(cfg, func(d *destination, b pack.Backend) error {
+			// TODO recovery mode should only perform recovery under p.Recover() and never under pack.New()
+			// in fact we should move this logic into a function (rather than method): pack.Recover(dst)
+			opts := packOptions(d, false)
+			opts.RepairFrom = repairFrom
+			p, err := pack.New(b, opts)
+			if err != nil {
+				return fmt.Errorf("failed to create new Pack: %s", err)
+			}
+			numOK, numRecovered, numFailed, err := p.Recover(ctx)
+			closeErr := p.Close()
+			if err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return fmt.Errorf("recovery of %s failed: %s", d.dst, err)
+			}
+			if numFailed > 0 {
+				return fmt.Errorf("recovery of %s failed to recover %d file(s) (%d file(s) were recovered, %d file(s) were OK)", d.dst, numFailed, numRecovered, numOK)
+			}
+			fmt.Printf("recovery of %s passed: %d corrupt file(s) were recovered (%d file(s) were OK)\n", d.dst, numRecovered, numOK)
+			return nil
+		})
+		return
+	}
+
+	backup(ctx, cfg, packOptions)
+}
+
+// forEachDst runs fn for every dst with its backend, reporting failures (including a backend which can't be opened)
+// rather than stopping at them; it exits with an error once they have all been tried if any of them failed
+func forEachDst(cfg *config, fn func(d *destination, b pack.Backend) error) {
+	numFailed := 0
+	for _, d := range cfg.dsts {
+		b, err := pack.OpenBackend(d.dst)
+		if err == nil {
+			err = fn(d, b)
+			pack.CloseBackend(b)
+		} else {
+			err = fmt.Errorf("failed to open %s: %s", d.dst, err)
+		}
 		if err != nil {
-			die("recovery of %s failed: %s\n", cfg.dst, err)
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			numFailed++
 		}
-		if numFailed > 0 {
-			die("recovery of %s failed to recover %d file(s) (%d file(s) were recovered, %d file(s) were OK)\n", cfg.dst, numFailed, numRecovered, numOK)
+	}
+	if numFailed > 0 {
+		if len(cfg.dsts) > 1 {
+			die("%d of %d destinations failed\n", numFailed, len(cfg.dsts))
 		}
+		os.Exit(1)
+	}
+}
 
-		fmt.Printf("recovery of %s passed: %d corrupt file(s) were recovered (%d file(s) were OK)\n", cfg.dst, numRecovered, numOK)
-		return
+// backup backs up src to every dst, reading each file once; a dst which can't be opened or fails part way through
+// doesn't stop the others from being backed up to
+func backup(ctx context.Context, cfg *config, packOptions func(*destination, bool) pack.Options) {
+	numFailed := 0
+	var packs []pack.Pack
+	var opened []*destination
+	var backends []pack.Backend
+	for _, d := range cfg.dsts {
+		b, err := pack.OpenBackend(d.dst)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open %s: %s\n", d.dst, err)
+			numFailed++
+			continue
+		}
+		backends = append(backends, b)
+		p, err := pack.New(b, packOptions(d, false))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create new Pack: %s\n", err)
+			numFailed++
+			continue
+		}
+		packs = append(packs, p)
+		opened = append(opened, d)
+	}
+	if len(packs) == 0 {
+		closeBackends(backends)
+		os.Exit(1)
 	}
 
-	if flags.List {
-		files, err := p.List()
+	// AddDir finishes the current file once ctx is cancelled; keep its progress as a partial snapshot
+	m := pack.NewMirror(packs)
+	err := m.AddDir(ctx, cfg.src, cfg.alias)
+	printVolatileFiles(m.VolatileFiles())
+	if errors.Is(err, context.Canceled) {
+		m.Checkpoint()
+		checkpointed := 0
+		for i, p := range packs {
+			p.Abort()
+			if m.Err(i) == nil {
+				checkpointed++
+			}
+		}
+		if checkpointed == 0 {
+			die("backup of %s was interrupted, and writing a partial snapshot failed\n", cfg.src)
+		}
+		die("backup of %s was interrupted; a partial snapshot was written, and the next run will resume from it\n", cfg.src)
+	}
+	if err != nil && !errors.Is(err, pack.ErrAllPacksFailed) {
+		for _, p := range packs {
+			p.Abort()
+		}
+		die("failed to add dir %s: %s\n", cfg.src, err)
+	}
+	fmt.Printf("done\n")
+
+	for i, p := range packs {
+		err := m.Err(i)
+		if err == nil {
+			err = p.Close()
+		} else {
+			p.Abort()
+		}
 		if err != nil {
-			die("failed to list contents of backup %s: %s\n", cfg.dst, err)
+			fmt.Fprintf(os.Stderr, "backup to %s failed: %s\n", opened[i].dst, err)
+			numFailed++
+		} else if len(cfg.dsts) > 1 {
+			fmt.Printf("backup to %s done\n", opened[i].dst)
 		}
-		for _, f := range files {
-			fmt.Println(f)
+	}
+	closeBackends(backends)
+	if numFailed > 0 {
+		if len(cfg.dsts) > 1 {
+			die("%d of %d destinations failed\n", numFailed, len(cfg.dsts))
+		}
+		os.Exit(1)
+	}
+}
+
+// closeBackends releases backends, ignoring any error as nothing is left to write to them
+func closeBackends(backends []pack.Backend) {
+	for _, b := range backends {
+		pack.CloseBackend(b)
+	}
+}
+
+// serve exposes the pack at dst over HTTP(S) until SIGINT or SIGTERM
+func serve(progName string, args []string) {
+	flags := serveFlags{}
+	parser := goflags.NewNamedParser("", goflags.PrintErrors|goflags.PassDoubleDash)
+	parser.AddGroup(fmt.Sprintf("%s serve [serve-options] <dst>", progName), "", &flags)
+	args, err := parser.ParseArgs(args)
+	if err != nil {
+		die("failed to parse flags: %s\n", err)
+	}
+	if flags.Help {
+		parser.WriteHelp(os.Stdout)
+		os.Exit(0)
+	}
+	if len(args) != 1 {
+		die("serve takes the dst of the pack to serve\n")
+	}
+	if (flags.TLSCert == "") != (flags.TLSKey == "") {
+		die("--tls-cert and --tls-key must be given together\n")
+	}
+	dst := args[0]
+	backend, err := pack.OpenBackend(dst)
+	if err != nil {
+		die("failed to open %s: %s\n", dst, err)
+	}
+	defer pack.CloseBackend(backend)
+
+	var token string
+	if flags.TokenFile != "" {
+		data, err := ioutil.ReadFile(flags.TokenFile)
+		if err != nil {
+			die("failed to read token: %s\n", err)
+		}
+		token = strings.TrimSpace(string(data))
+		if token == "" {
+			die("token file %s is empty\n", flags.TokenFile)
 		}
+	} else {
+		fmt.Fprintf(os.Stderr, "WARNING: no --token-file was given; anyone who can connect to %s can access %s\n", flags.Listen, dst)
+	}
+
+	server := &http.Server{
+		Addr:    flags.Listen,
+		Handler: pack.NewServer(backend, pack.ServerOptions{Token: token, AppendOnly: flags.AppendOnly}),
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	mode := ""
+	if flags.AppendOnly {
+		mode = " (append-only)"
+	}
+	fmt.Printf("serving %s%s on %s\n", dst, mode, flags.Listen)
+	if flags.TLSCert != "" {
+		err = server.ListenAndServeTLS(flags.TLSCert, flags.TLSKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		die("failed to serve %s: %s\n", dst, err)
+	}
+}
+
+// sync brings the pack at --to up to date with the snapshots of the pack at --from
+func sync(progName string, args []string) {
+	flags := syncFlags{}
+	parser := goflags.NewNamedParser("", goflags.PrintErrors|goflags.PassDoubleDash)
+	parser.AddGroup(fmt.Sprintf("%s sync [sync-options] --from=<dst> --to=<dst>", progName), "", &flags)
+	args, err := parser.ParseArgs(args)
+	if err != nil {
+		die("failed to parse flags: %s\n", err)
+	}
+	if flags.Help {
+		parser.WriteHelp(os.Stdout)
+		os.Exit(0)
+	}
+	if len(args) != 0 {
+		die("unhandled args: %v", args)
+	}
+	if flags.From == "" || flags.To == "" {
+		die("sync requires --from and --to\n")
+	}
+	from, err := pack.OpenBackend(flags.From)
+	if err != nil {
+		die("failed to open %s: %s\n", flags.From, err)
+	}
+	defer pack.CloseBackend(from)
+	to, err := pack.OpenBackend(flags.To)
+	if err != nil {
+		die("failed to open %s: %s\n", flags.To, err)
+	}
+	defer pack.CloseBackend(to)
+
+	stats, err := pack.Sync(interruptContext(), from, to, pack.SyncOptions{DryRun: flags.DryRun})
+	if err != nil {
+		die("sync of %s to %s failed: %s\n", flags.From, flags.To, err)
+	}
+	history := "fast-forwarded"
+	if stats.Merged {
+		history = "merged"
+	}
+	switch {
+	case stats.Snapshots == 0 && stats.Skipped == 0:
+		fmt.Printf("%s is up to date with %s\n", flags.To, flags.From)
+	case flags.DryRun:
+		fmt.Printf("would copy %d snapshot(s) from %s to %s: %d object(s), %d byte(s); history would be %s\n", stats.Snapshots, flags.From, flags.To, stats.Objects, stats.Bytes, history)
+	default:
+		fmt.Printf("copied %d snapshot(s) from %s to %s: %d object(s), %d byte(s); history was %s\n", stats.Snapshots, flags.From, flags.To, stats.Objects, stats.Bytes, history)
+	}
+	if stats.Skipped > 0 {
+		verb := "were"
+		if flags.DryRun {
+			verb = "would be"
+		}
+		fmt.Printf("%d snapshot(s) %s skipped, as their refs or objects are missing from %s\n", stats.Skipped, verb, flags.From)
+	}
+}
+
+// bundle creates or applies a bundle, which carries snapshots to a pack that can't be reached by any backend
+func bundle(progName string, args []string) {
+	if len(args) > 0 && args[0] == "create" {
+		bundleCreate(progName, args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "apply" {
+		bundleApply(progName, args[1:])
 		return
 	}
+	die("usage: %s bundle create|apply [options] <file>\n", progName)
+}
 
-	err = p.AddDir(cfg.src, cfg.alias)
+// bundleCreate writes the snapshots of the pack at --from which are newer than --since to a bundle file
+func bundleCreate(progName string, args []string) {
+	flags := bundleCreateFlags{}
+	parser := goflags.NewNamedParser("", goflags.PrintErrors|goflags.PassDoubleDash)
+	parser.AddGroup(fmt.Sprintf("%s bundle create [--since=<snapshot>] --from=<dst> <file>", progName), "", &flags)
+	args, err := parser.ParseArgs(args)
 	if err != nil {
-		die("failed to add dir %s: %s\n", cfg.src, err)
+		die("failed to parse flags: %s\n", err)
 	}
-	fmt.Printf("done\n")
+	if flags.Help {
+		parser.WriteHelp(os.Stdout)
+		os.Exit(0)
+	}
+	if len(args) != 1 || flags.From == "" {
+		die("bundle create requires --from and the file to write\n")
+	}
+	path := args[0]
+	from, err := pack.OpenBackend(flags.From)
+	if err != nil {
+		die("failed to open %s: %s\n", flags.From, err)
+	}
+	defer pack.CloseBackend(from)
 
-	err = p.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		die("failed to create %s: %s\n", path, err)
+	}
+	stats, err := pack.CreateBundle(interruptContext(), from, f, pack.BundleOptions{Since: flags.Since})
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		die("failed to bundle %s: %s\n", flags.From, err)
+	}
+	if stats.Snapshots == 0 {
+		os.Remove(path)
+		fmt.Printf("%s has no snapshots newer than %s; no bundle was written\n", flags.From, flags.Since)
+		return
+	}
+	fmt.Printf("bundled %d snapshot(s) from %s to %s: %d object(s), %d byte(s)\n", stats.Snapshots, flags.From, path, stats.Objects, stats.Bytes)
+	fmt.Printf("the next bundle can be created with --since=%s\n", stats.Head)
+}
+
+// bundleApply imports a bundle file into the pack at --to
+func bundleApply(progName string, args []string) {
+	flags := bundleApplyFlags{}
+	parser := goflags.NewNamedParser("", goflags.PrintErrors|goflags.PassDoubleDash)
+	parser.AddGroup(fmt.Sprintf("%s bundle apply --to=<dst> <file>", progName), "", &flags)
+	args, err := parser.ParseArgs(args)
+	if err != nil {
+		die("failed to parse flags: %s\n", err)
+	}
+	if flags.Help {
+		parser.WriteHelp(os.Stdout)
+		os.Exit(0)
+	}
+	if len(args) != 1 || flags.To == "" {
+		die("bundle apply requires --to and the bundle file\n")
+	}
+	path := args[0]
+	to, err := pack.OpenBackend(flags.To)
 	if err != nil {
-		die("failed to close pack %s: %s\n", cfg.dst, err)
+		die("failed to open %s: %s\n", flags.To, err)
+	}
+	defer pack.CloseBackend(to)
+
+	f, err := os.Open(path)
+	if err != nil {
+		die("failed to open %s: %s\n", path, err)
+	}
+	defer f.Close()
+	stats, err := pack.ApplyBundle(interruptContext(), to, f)
+	if err != nil {
+		die("failed to apply %s to %s: %s\n", path, flags.To, err)
+	}
+	if stats.Snapshots == 0 {
+		fmt.Printf("%s already has every snapshot in %s\n", flags.To, path)
+		return
+	}
+	history := "fast-forwarded"
+	if stats.Merged {
+		history = "merged"
+	}
+	fmt.Printf("applied %d snapshot(s) from %s to %s: %d object(s), %d byte(s); history was %s\n", stats.Snapshots, path, flags.To, stats.Objects, stats.Bytes, history)
+}
+
+// export writes the files of a snapshot to stdout as an archive
+func export(progName string, args []string) {
+	flags := exportFlags{}
+	parser := goflags.NewNamedParser("", goflags.PrintErrors|goflags.PassDoubleDash)
+	parser.AddGroup(fmt.Sprintf("%s export [export-options] --from=<dst> > <archive>", progName), "", &flags)
+	args, err := parser.ParseArgs(args)
+	if err != nil {
+		die("failed to parse flags: %s\n", err)
+	}
+	if flags.Help {
+		parser.WriteHelp(os.Stdout)
+		os.Exit(0)
+	}
+	if len(args) != 0 {
+		die("unhandled args: %v", args)
+	}
+	if flags.From == "" {
+		die("export requires --from\n")
+	}
+	if termutil.IsTTY() {
+		die("refusing to write an archive to a terminal; redirect stdout to a file\n")
+	}
+	from, err := pack.OpenBackend(flags.From)
+	if err != nil {
+		die("failed to open %s: %s\n", flags.From, err)
+	}
+	defer pack.CloseBackend(from)
+
+	out := bufio.NewWriter(os.Stdout)
+	stats, err := pack.Export(interruptContext(), from, out, pack.ExportOptions{
+		Snapshot: flags.Snapshot,
+		Format:   pack.ExportFormat(flags.Format),
+		Prefix:   flags.Prefix,
+	})
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		die("export of %s failed: %s\n", flags.From, err)
+	}
+	fmt.Fprintf(os.Stderr, "exported %d file(s), %d byte(s)\n", stats.Files, stats.Bytes)
+}
+
+// importTar records the contents of a tar archive as a snapshot, dated from the archive's modification time
+func importTar(progName string, args []string) {
+	flags := importTarFlags{}
+	parser := goflags.NewNamedParser("", goflags.PrintErrors|goflags.PassDoubleDash)
+	parser.AddGroup(fmt.Sprintf("%s import-tar --to=<dst> --alias=<path> <archive>", progName), "", &flags)
+	args, err := parser.ParseArgs(args)
+	if err != nil {
+		die("failed to parse flags: %s\n", err)
+	}
+	if flags.Help {
+		parser.WriteHelp(os.Stdout)
+		os.Exit(0)
+	}
+	if len(args) != 1 || flags.To == "" || flags.Alias == "" {
+		die("import-tar requires --to, --alias, and the archive to import\n")
+	}
+	path := args[0]
+	to, err := pack.OpenBackend(flags.To)
+	if err != nil {
+		die("failed to open %s: %s\n", flags.To, err)
+	}
+	defer pack.CloseBackend(to)
+
+	f, err := os.Open(path)
+	if err != nil {
+		die("failed to open %s: %s\n", path, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		die("failed to stat %s: %s\n", path, err)
+	}
+	stats, err := pack.ImportTar(interruptContext(), to, f, pack.ImportOptions{Alias: flags.Alias, Time: info.ModTime()})
+	if err != nil {
+		die("import of %s into %s failed: %s\n", path, flags.To, err)
+	}
+	fmt.Printf("imported %d file(s), %d byte(s) from %s into %s as snapshot %s dated %s\n", stats.Files, stats.Bytes, path, flags.To, stats.Snapshot, info.ModTime().Format(time.RFC3339))
+	if stats.Skipped > 0 {
+		fmt.Printf("%d entries which can't be recorded (such as devices) were skipped\n", stats.Skipped)
+	}
+}
+
+// cat writes a backed up file to stdout
+func cat(progName string, args []string) {
+	flags := catFlags{}
+	parser := goflags.NewNamedParser("", goflags.PrintErrors|goflags.PassDoubleDash)
+	parser.AddGroup(fmt.Sprintf("%s cat [--snapshot=<id>] --from=<dst> <path>", progName), "", &flags)
+	args, err := parser.ParseArgs(args)
+	if err != nil {
+		die("failed to parse flags: %s\n", err)
+	}
+	if flags.Help {
+		parser.WriteHelp(os.Stdout)
+		os.Exit(0)
+	}
+	if len(args) != 1 || flags.From == "" {
+		die("cat requires --from and the path of the file (as it was backed up)\n")
+	}
+	catFrom(flags.From, func(p pack.Pack) (io.ReadCloser, error) {
+		return p.OpenSnapshot(flags.Snapshot, args[0])
+	})
+}
+
+// catObject writes the object with the given sha1 to stdout
+func catObject(progName string, args []string) {
+	flags := catObjectFlags{}
+	parser := goflags.NewNamedParser("", goflags.PrintErrors|goflags.PassDoubleDash)
+	parser.AddGroup(fmt.Sprintf("%s cat-object --from=<dst> <sha1>", progName), "", &flags)
+	args, err := parser.ParseArgs(args)
+	if err != nil {
+		die("failed to parse flags: %s\n", err)
+	}
+	if flags.Help {
+		parser.WriteHelp(os.Stdout)
+		os.Exit(0)
+	}
+	if len(args) != 1 || flags.From == "" {
+		die("cat-object requires --from and the sha1 of the object\n")
+	}
+	catFrom(flags.From, func(p pack.Pack) (io.ReadCloser, error) {
+		return p.OpenObject(args[0])
+	})
+}
+
+// catFrom streams what open returns from the pack at dst to stdout; an object with no intact copy is reported (with a
+// non-zero exit) before anything is written
+func catFrom(dst string, open func(pack.Pack) (io.ReadCloser, error)) {
+	b, err := pack.OpenBackend(dst)
+	if err != nil {
+		die("failed to open %s: %s\n", dst, err)
+	}
+	p, err := pack.OpenReadOnly(b)
+	if err != nil {
+		die("failed to open pack %s: %s\n", dst, err)
+	}
+	r, err := open(p)
+	if err == nil {
+		out := bufio.NewWriter(os.Stdout)
+		_, err = io.Copy(out, r)
+		r.Close()
+		flushErr := out.Flush()
+		if err == nil {
+			err = flushErr
+		}
+	}
+	p.Close()
+	pack.CloseBackend(b)
+	if err != nil {
+		die("%s\n", err)
+	}
+}
+
+// interruptContext returns a context which is cancelled on SIGINT or SIGTERM; a second signal kills the process
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		fmt.Fprintf(os.Stderr, "received %s; stopping after the current file\n", sig)
+		signal.Stop(sigs)
+		cancel()
+	}()
+	return ctx
+}
+
+// printVolatileFiles summarizes the files which changed while they were being backed up
+func printVolatileFiles(files []pack.VolatileFile) {
+	if len(files) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "WARNING: %d file(s) changed while they were being backed up:\n", len(files))
+	for _, f := range files {
+		outcome := "not stored"
+		if f.Stored {
+			outcome = "stored"
+		}
+		fmt.Fprintf(os.Stderr, "  %s (%d attempt(s), %s)\n", f.Path, f.Attempts, outcome)
 	}
 }
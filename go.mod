@@ -4,12 +4,15 @@ go 1.17
 
 require (
 	github.com/jessevdk/go-flags v1.5.0
+	github.com/pkg/sftp v1.13.5
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/sys v0.0.0-20210320140829-1e4c9ba3b0c4 // indirect
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
@@ -0,0 +1,306 @@
+package pack
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrAppendOnly is returned for operations which would overwrite or delete data in an append-only pack; it matches
+// os.ErrPermission
+var ErrAppendOnly = fmt.Errorf("not allowed in an append-only pack (%w)", os.ErrPermission)
+
+// repairSuffix names the extra copies which repair a damaged object of an append-only pack, where the damaged copy
+// can't be rewritten: <sha1>.repair.1, <sha1>.repair.2, ...
+const repairSuffix = ".repair."
+
+// objectSealer is implemented by backends which can make objects read-only once they have been written
+type objectSealer interface {
+	sealObjects()
+}
+
+// appendOnlyBackend refuses operations which would lose history: objects can't be deleted or replaced, meta can't be
+// replaced, the reflog copies can only gain entries, and refs can only point to stored objects. Only lock files can
+// be removed.
+type appendOnlyBackend struct {
+	Backend
+}
+
+// newAppendOnlyBackend wraps b so that it refuses operations which would lose history, and seals the objects which
+// are written through it (if b supports that)
+func newAppendOnlyBackend(b Backend) Backend {
+	if isAppendOnly(b) {
+		return b
+	}
+	if s, ok := b.(objectSealer); ok {
+		s.sealObjects()
+	}
+	return &appendOnlyBackend{Backend: b}
+}
+
+func isAppendOnly(b Backend) bool {
+	_, ok := b.(*appendOnlyBackend)
+	return ok
+}
+
+func appendOnlyError(op, name string) error {
+	return fmt.Errorf("%s %s: %w", op, name, ErrAppendOnly)
+}
+
+// cleanTemp is passed through, since temporary files aren't part of the pack
+func (b *appendOnlyBackend) cleanTemp() error {
+	if tc, ok := b.Backend.(tempCleaner); ok {
+		return tc.cleanTemp()
+	}
+	return nil
+}
+
+type appendOnlyObjectWriter struct {
+	ObjectWriter
+	b *appendOnlyBackend
+}
+
+func (b *appendOnlyBackend) CreateObject() (ObjectWriter, error) {
+	w, err := b.Backend.CreateObject()
+	if err != nil {
+		return nil, err
+	}
+	return &appendOnlyObjectWriter{ObjectWriter: w, b: b}, nil
+}
+
+// Commit only stores new objects; since an object's name is its hash, committing an object which is already
+// stored intact changes nothing, and is skipped
+func (w *appendOnlyObjectWriter) Commit(name string) error {
+	exists, err := objectExists(w.b.Backend, name)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	if !exists {
+		return w.ObjectWriter.Commit(name)
+	}
+	w.Abort()
+	err = verifyObject(w.b.Backend, name, name[:40])
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, ErrAppendOnly)
+	}
+	return nil
+}
+
+func (b *appendOnlyBackend) DeleteObject(name string) error {
+	return appendOnlyError("delete", b.ObjectLocation(name))
+}
+
+// checkWrite returns an error if name can't be given the contents data
+func (b *appendOnlyBackend) checkWrite(name string, data []byte) error {
+	if strings.HasPrefix(name, locksDirName+"/") {
+		return nil
+	}
+	current, err := b.Backend.ReadFile(name)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		current = nil
+	}
+	switch {
+	case name == metaFileName:
+		if current != nil {
+			return appendOnlyError("replace", name)
+		}
+		return nil
+	case name == refsFileName:
+		// the pointer must name intact refs, rather than any stored object (which would make the refs unreadable)
+		sha := string(data)
+		if !isSha1(sha) {
+			return fmt.Errorf("refs must point to stored refs: %w", ErrAppendOnly)
+		}
+		intact, err := intactCopies(b.Backend, sha)
+		if err != nil {
+			return err
+		}
+		if len(intact) == 0 {
+			return fmt.Errorf("refs must point to stored refs: %w", ErrAppendOnly)
+		}
+		_, err = readRefsObject(b.Backend, intact[0])
+		if err != nil {
+			return fmt.Errorf("refs must point to stored refs (%s): %w", err, ErrAppendOnly)
+		}
+		return nil
+	case isReflogCopy(name):
+		// damaged records may be dropped (so that --recover can rewrite a damaged copy), but valid entries must be kept
+		oldEntries, _ := parseReflog(current)
+		newEntries, _ := parseReflog(data)
+		for _, e := range oldEntries {
+			if !containsReflogEntry(newEntries, e) {
+				return appendOnlyError("remove entries from", name)
+			}
+		}
+		return nil
+	}
+	return appendOnlyError("write", name)
+}
+
+func (b *appendOnlyBackend) WriteFile(name string, data []byte) error {
+	err := b.checkWrite(name, data)
+	if err != nil {
+		return err
+	}
+	return b.Backend.WriteFile(name, data)
+}
+
+func (b *appendOnlyBackend) CreateFile(name string, data []byte) error {
+	err := b.checkWrite(name, data)
+	if err != nil {
+		return err
+	}
+	return b.Backend.CreateFile(name, data)
+}
+
+func (b *appendOnlyBackend) SwapFile(name string, old, data []byte) error {
+	err := b.checkWrite(name, data)
+	if err != nil {
+		return err
+	}
+	return b.Backend.SwapFile(name, old, data)
+}
+
+func (b *appendOnlyBackend) RemoveFile(name string) error {
+	if !strings.HasPrefix(name, locksDirName+"/") {
+		return appendOnlyError("remove", name)
+	}
+	return b.Backend.RemoveFile(name)
+}
+
+// objectNameSha1 returns the sha1 which an object name refers to; ok is false unless the name is a sha1, optionally
+// followed by the bkup suffix or a repair suffix
+func objectNameSha1(name string) (sha1 string, ok bool) {
+	if len(name) < 40 || !isSha1(name[:40]) {
+		return "", false
+	}
+	suffix := name[40:]
+	if suffix == "" || suffix == bkupSuffix {
+		return name[:40], true
+	}
+	if !strings.HasPrefix(suffix, repairSuffix) {
+		return "", false
+	}
+	n, err := strconv.Atoi(suffix[len(repairSuffix):])
+	if err != nil || n < 1 || strconv.Itoa(n) != suffix[len(repairSuffix):] {
+		return "", false
+	}
+	return name[:40], true
+}
+
+// objectCopies returns the names of the stored copies of an object: the object itself, its bkup, and any repair
+// copies (which are numbered without gaps, since nothing is deleted from an append-only pack)
+func objectCopies(b Backend, sha1 string) ([]string, error) {
+	var names []string
+	for _, name := range []string{sha1, sha1 + bkupSuffix} {
+		ok, err := objectExists(b, name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			names = append(names, name)
+		}
+	}
+	for n := 1; ; n++ {
+		name := fmt.Sprintf("%s%s%d", sha1, repairSuffix, n)
+		ok, err := objectExists(b, name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return names, nil
+		}
+		names = append(names, name)
+	}
+}
+
+// nextCopyName returns the name under which a new copy of an object can be stored: the object itself or its bkup if
+// they are missing, and otherwise the next repair copy
+func nextCopyName(b Backend, sha1 string) (string, error) {
+	for _, name := range []string{sha1, sha1 + bkupSuffix} {
+		ok, err := objectExists(b, name)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return name, nil
+		}
+	}
+	for n := 1; ; n++ {
+		name := fmt.Sprintf("%s%s%d", sha1, repairSuffix, n)
+		ok, err := objectExists(b, name)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return name, nil
+		}
+	}
+}
+
+// intactCopies returns the names of the copies of an object whose contents match sha1
+func intactCopies(b Backend, sha1 string) ([]string, error) {
+	names, err := objectCopies(b, sha1)
+	if err != nil {
+		return nil, err
+	}
+	var intact []string
+	for _, name := range names {
+		actualSha1, err := hashObject(b, name)
+		if err != nil {
+			return nil, err
+		}
+		if actualSha1 == sha1 {
+			intact = append(intact, name)
+		}
+	}
+	return intact, nil
+}
+
+// intactCopy returns the name of an intact copy of an object: the object itself or, in an append-only pack (where a
+// damaged object can't be rewritten), any of its copies
+func intactCopy(b Backend, sha1 string) (string, error) {
+	err := verifyObject(b, sha1, sha1)
+	if err == nil || !isAppendOnly(b) {
+		return sha1, err
+	}
+	intact, copiesErr := intactCopies(b, sha1)
+	if copiesErr != nil {
+		return "", copiesErr
+	}
+	if len(intact) == 0 {
+		return "", err
+	}
+	return intact[0], nil
+}
+
+// addRepairCopy stores another copy of an object of an append-only pack, copied from an intact one
+func addRepairCopy(b Backend, sha1 string) error {
+	intact, err := intactCopies(b, sha1)
+	if err != nil {
+		return err
+	}
+	if len(intact) == 0 {
+		return fmt.Errorf("no intact copy of %s exists", b.ObjectLocation(sha1))
+	}
+	dst, err := nextCopyName(b, sha1)
+	if err != nil {
+		return err
+	}
+	err = copyObject(b, intact[0], dst)
+	if err != nil {
+		return err
+	}
+	err = verifyObject(b, dst, sha1)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "repaired %s by copying %s to %s\n", sha1, b.ObjectLocation(intact[0]), b.ObjectLocation(dst))
+	return nil
+}
@@ -0,0 +1,140 @@
+package pack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// tmpDirName is the directory within the pack that holds partially written files; it lives inside the pack so
+// that renames into place never cross filesystems
+const tmpDirName = "tmp"
+
+// crashPoint is called before each step of a write that must survive a crash; tests replace it to simulate a
+// crash (or power loss) at that step
+var crashPoint = func(step string) error { return nil }
+
+// atomicFile is a temporary file which replaces dst (with fsync) on Commit
+type atomicFile struct {
+	f        *os.File
+	packRoot string
+	dst      string
+}
+
+func createAtomic(packRoot, dst string) (*atomicFile, error) {
+	tmpDir := filepath.Join(packRoot, tmpDirName)
+	err := mkdirAllSync(tmpDir)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(tmpDir, filepath.Base(dst)+".")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{
+		f:        f,
+		packRoot: packRoot,
+		dst:      dst,
+	}, nil
+}
+
+func (a *atomicFile) Write(p []byte) (int, error) {
+	err := crashPoint("write " + a.dst)
+	if err != nil {
+		return 0, err
+	}
+	return a.f.Write(p)
+}
+
+// Commit syncs the temporary file to disk and renames it over dst
+func (a *atomicFile) Commit() error {
+	err := crashPoint("sync " + a.dst)
+	if err != nil {
+		return err
+	}
+	err = a.f.Sync()
+	if err != nil {
+		a.Abort()
+		return err
+	}
+	err = a.f.Close()
+	if err != nil {
+		os.Remove(a.f.Name())
+		return err
+	}
+	err = mkdirAllSync(filepath.Dir(a.dst))
+	if err != nil {
+		os.Remove(a.f.Name())
+		return err
+	}
+	err = crashPoint("rename " + a.dst)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(a.f.Name(), a.dst)
+	if err != nil {
+		os.Remove(a.f.Name())
+		return err
+	}
+	err = crashPoint("sync dir " + a.dst)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(a.dst))
+}
+
+// Abort discards the temporary file
+func (a *atomicFile) Abort() {
+	a.f.Close()
+	os.Remove(a.f.Name())
+}
+
+// writeFileAtomic replaces dst with data such that a crash leaves either the old or the new contents
+func writeFileAtomic(packRoot, dst string, data []byte) error {
+	a, err := createAtomic(packRoot, dst)
+	if err != nil {
+		return err
+	}
+	_, err = a.Write(data)
+	if err != nil {
+		a.Abort()
+		return err
+	}
+	return a.Commit()
+}
+
+// mkdirAllSync is like os.MkdirAll, but also syncs the parent of every directory it creates
+func mkdirAllSync(path string) error {
+	info, err := os.Stat(path)
+	if err == nil {
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: path, Err: os.ErrExist}
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	parent := filepath.Dir(path)
+	if parent != path {
+		err = mkdirAllSync(parent)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Mkdir(path, 0700)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	return syncDir(parent)
+}
+
+// syncDir flushes directory entries (e.g. a rename) to disk
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
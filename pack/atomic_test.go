@@ -0,0 +1,121 @@
+package pack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errSimulatedCrash = errors.New("simulated crash")
+
+// crashAfter makes the n-th crash point (counting from 1) fail, and every one after it, as the process would be dead
+func crashAfter(n int) (restore func(), crashed func() bool) {
+	orig := crashPoint
+	count := 0
+	crashPoint = func(step string) error {
+		count++
+		if count >= n {
+			return errSimulatedCrash
+		}
+		return nil
+	}
+	return func() { crashPoint = orig }, func() bool { return count >= n }
+}
+
+// assertPackConsistent checks that the pack can be opened, that every file it lists is intact, and that every
+// object stored under data/ has contents that match its name
+func assertPackConsistent(t *testing.T, root string, parityBits int) []string {
+	p, err := New(NewLocalBackend(root), Options{ReadOnly: true, ParityBits: parityBits})
+	if !assert.Nil(t, err) {
+		return nil
+	}
+	for _, ref := range p.(*packImp).refs {
+		assert.Nil(t, p.(*packImp).verifyData(ref.sha1))
+	}
+
+	err = filepath.Walk(filepath.Join(root, "data"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		actual, err := getSha1(path)
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, strings.TrimSuffix(filepath.Base(path), ".bkup"), actual, "%s is corrupt", path)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	files, err := p.List()
+	assert.Nil(t, err)
+	assert.Nil(t, p.Close())
+	return files
+}
+
+func assertPackVerifies(t *testing.T, root string, parityBits int) {
+	p, err := New(NewLocalBackend(root), Options{ReadOnly: true, ParityBits: parityBits})
+	if assert.Nil(t, err) {
+		assert.True(t, verifyPack(t, p))
+		assert.Nil(t, p.Close())
+	}
+}
+
+func TestCrashInjection(t *testing.T) {
+	for _, parityBits := range []int{0, 1} {
+		for n := 1; ; n++ {
+			root := t.TempDir()
+			dir := t.TempDir()
+			_, err := Init(NewLocalBackend(root), parityBits, false)
+			assert.Nil(t, err)
+
+			for i := 0; i < 3; i++ {
+				path := filepath.Join(dir, fmt.Sprintf("%d.txt", i))
+				assert.Nil(t, ioutil.WriteFile(path, []byte(fmt.Sprintf("file %d\n", i)), 0600))
+			}
+			p, err := New(NewLocalBackend(root), Options{ParityBits: parityBits})
+			assert.Nil(t, err)
+			assert.Nil(t, p.AddDir(context.Background(), dir, dir))
+			assert.Nil(t, p.Close())
+			before := assertPackConsistent(t, root, parityBits)
+			assertPackVerifies(t, root, parityBits)
+
+			assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "new.txt"), []byte("new\n"), 0600))
+			restore, crashed := crashAfter(n)
+			p, err = New(NewLocalBackend(root), Options{ParityBits: parityBits})
+			assert.Nil(t, err)
+			err = p.AddDir(context.Background(), dir, dir)
+			if err == nil {
+				err = p.Close()
+			}
+			restore()
+
+			if !crashed() {
+				assert.Nil(t, err)
+				assert.Len(t, assertPackConsistent(t, root, parityBits), len(before)+1)
+				assertPackVerifies(t, root, parityBits)
+				break
+			}
+			assert.True(t, errors.Is(err, errSimulatedCrash), "crash point %d: %v", n, err)
+			// a crashed process leaves its lock behind, which the next run takes over as stale
+			p.Abort()
+
+			after := assertPackConsistent(t, root, parityBits)
+			assert.Subset(t, after, before, "crash point %d lost files", n)
+
+			// the next run must be able to complete the backup, and repair anything left over from the crash
+			p, err = New(NewLocalBackend(root), Options{ParityBits: parityBits})
+			assert.Nil(t, err)
+			assert.Nil(t, p.AddDir(context.Background(), dir, dir))
+			assert.Nil(t, p.Close())
+			assert.Len(t, assertPackConsistent(t, root, parityBits), len(before)+1)
+			assertPackVerifies(t, root, parityBits)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package pack
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Backend stores the objects and small files (meta, refs pointer, reflog, and locks) which make up a pack.
+// Object names are a sha1, optionally followed by a suffix such as ".bkup"; file names are slash separated paths
+// relative to the root of the pack, e.g. "refs" or "locks/exclusive". Missing objects and files are reported with
+// errors matching os.ErrNotExist.
+type Backend interface {
+	// String describes where the pack is stored
+	String() string
+	// ObjectLocation describes where an object is stored, for messages
+	ObjectLocation(name string) string
+
+	// CreateObject returns a writer for a new object; its name is given once it has been written
+	CreateObject() (ObjectWriter, error)
+	// GetObject opens an object for reading
+	GetObject(name string) (io.ReadCloser, error)
+	// StatObject returns the size and modification time of an object
+	StatObject(name string) (Info, error)
+	// ListObjects returns every object
+	ListObjects() ([]Info, error)
+	// DeleteObject removes an object
+	DeleteObject(name string) error
+
+	// ReadFile returns the contents of a file
+	ReadFile(name string) ([]byte, error)
+	// StatFile returns the size and modification time of a file
+	StatFile(name string) (Info, error)
+	// WriteFile replaces the contents of a file such that readers (and a crash) see either the old or new contents
+	WriteFile(name string, data []byte) error
+	// CreateFile creates a file which must not already exist; otherwise an error matching os.ErrExist is returned
+	CreateFile(name string, data []byte) error
+	// SwapFile is like WriteFile, but only replaces the file if it still contains old (nil meaning the file must
+	// not exist); otherwise ErrSwapConflict is returned
+	SwapFile(name string, old, data []byte) error
+	// RemoveFile removes a file; removing a file which doesn't exist isn't an error
+	RemoveFile(name string) error
+	// ListFiles returns the names of the files which start with prefix; the prefix may only name files within a
+	// single directory (e.g. "locks/shared.")
+	ListFiles(prefix string) ([]string, error)
+}
+
+// ObjectWriter writes a new object
+type ObjectWriter interface {
+	io.Writer
+	// Commit durably stores the object under name, replacing any existing object of that name
+	Commit(name string) error
+	// Abort discards the object
+	Abort()
+}
+
+// Info describes an object or file
+type Info struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// ErrSwapConflict is returned by SwapFile when a file was changed by someone else
+var ErrSwapConflict = errors.New("file was changed by another process")
+
+// tempCleaner is implemented by backends which can leave temporary files behind after a crash; it's called once
+// the exclusive lock is held
+type tempCleaner interface {
+	cleanTemp() error
+}
+
+const (
+	refsFileName = "refs"
+	bkupSuffix   = ".bkup"
+)
+
+// OpenBackend returns the backend which stores the pack at dst
+func OpenBackend(dst string) (Backend, error) {
+	if strings.HasPrefix(dst, "s3://") {
+		return newS3BackendFromURL(dst)
+	}
+	if strings.HasPrefix(dst, "sftp://") {
+		return newSFTPBackendFromURL(dst)
+	}
+	if strings.HasPrefix(dst, "http://") || strings.HasPrefix(dst, "https://") {
+		return newHTTPBackendFromURL(dst)
+	}
+	if i := strings.Index(dst, "://"); i >= 0 {
+		return nil, fmt.Errorf("unsupported dst %s: unknown scheme %s", dst, dst[:i])
+	}
+	return NewLocalBackend(dst), nil
+}
+
+// CloseBackend releases what a backend returned by OpenBackend holds open, such as the connection of an sftp:// one
+func CloseBackend(b Backend) error {
+	if c, ok := b.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func fileExists(b Backend, name string) bool {
+	_, err := b.StatFile(name)
+	return err == nil
+}
+
+func objectExists(b Backend, name string) (bool, error) {
+	_, err := b.StatObject(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// hashObject returns the sha1 of the contents of an object
+func hashObject(b Backend, name string) (string, error) {
+	r, err := b.GetObject(name)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := sha1.New()
+	_, err = io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// putObject stores data as an object
+func putObject(b Backend, name string, data []byte) error {
+	w, err := b.CreateObject()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit(name)
+}
+
+// copyObject stores a copy of the object src under dst
+func copyObject(b Backend, src, dst string) error {
+	r, err := b.GetObject(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := b.CreateObject()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit(dst)
+}
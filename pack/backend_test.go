@@ -0,0 +1,125 @@
+package pack
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackends(t *testing.T) {
+	for _, b := range []Backend{NewLocalBackend(t.TempDir()), NewMemoryBackend()} {
+		testBackend(t, b)
+	}
+}
+
+// testBackend checks that an empty backend implements the Backend interface
+func testBackend(t *testing.T, b Backend) {
+	// the sha1 of "hello\n", since some backends check that objects match their names
+	name := "f572d396fae9206628714fb2ce00f72e94f2258f"
+
+	_, err := b.GetObject(name)
+	assert.True(t, errors.Is(err, os.ErrNotExist), "%s: got %v", b, err)
+
+	w, err := b.CreateObject()
+	assert.Nil(t, err)
+	_, err = w.Write([]byte("discarded"))
+	assert.Nil(t, err)
+	w.Abort()
+	objects, err := b.ListObjects()
+	assert.Nil(t, err)
+	assert.Len(t, objects, 0, "%s", b)
+
+	assert.Nil(t, putObject(b, name, []byte("hello\n")))
+	assert.Nil(t, copyObject(b, name, name+bkupSuffix))
+	r, err := b.GetObject(name + bkupSuffix)
+	assert.Nil(t, err)
+	data, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Nil(t, r.Close())
+	assert.Equal(t, "hello\n", string(data))
+	info, err := b.StatObject(name)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), info.Size)
+
+	objects, err = b.ListObjects()
+	assert.Nil(t, err)
+	var names []string
+	for _, o := range objects {
+		names = append(names, o.Name)
+	}
+	assert.ElementsMatch(t, []string{name, name + bkupSuffix}, names, "%s", b)
+
+	assert.Nil(t, b.DeleteObject(name+bkupSuffix))
+	_, err = b.StatObject(name + bkupSuffix)
+	assert.True(t, errors.Is(err, os.ErrNotExist), "%s: got %v", b, err)
+
+	_, err = b.ReadFile("refs")
+	assert.True(t, errors.Is(err, os.ErrNotExist), "%s: got %v", b, err)
+	assert.Equal(t, ErrSwapConflict, b.SwapFile("refs", []byte("a"), []byte("b")))
+	assert.Nil(t, b.SwapFile("refs", nil, []byte("a")))
+	assert.Equal(t, ErrSwapConflict, b.SwapFile("refs", nil, []byte("b")))
+	assert.Nil(t, b.SwapFile("refs", []byte("a"), []byte("b")))
+	data, err = b.ReadFile("refs")
+	assert.Nil(t, err)
+	assert.Equal(t, "b", string(data))
+
+	assert.Nil(t, b.CreateFile("locks/shared.1", []byte("1")))
+	err = b.CreateFile("locks/shared.1", []byte("1"))
+	assert.True(t, errors.Is(err, os.ErrExist), "%s: got %v", b, err)
+	assert.Nil(t, b.WriteFile("locks/shared.2", []byte("2")))
+	assert.Nil(t, b.WriteFile("locks/exclusive", []byte("3")))
+	files, err := b.ListFiles("locks/shared.")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"locks/shared.1", "locks/shared.2"}, files, "%s", b)
+
+	assert.Nil(t, b.RemoveFile("locks/shared.1"))
+	assert.Nil(t, b.RemoveFile("locks/shared.1"))
+	assert.False(t, fileExists(b, "locks/shared.1"))
+}
+
+func TestMemoryBackendPack(t *testing.T) {
+	b := NewMemoryBackend()
+	testBackendPack(t, b, b)
+}
+
+// testBackendPack backs up, verifies, restores, and recovers a pack stored in an empty backend; the pack is
+// damaged by writing to raw, which is the backend holding the pack (b may be a client for it)
+func testBackendPack(t *testing.T, b, raw Backend) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.txt")
+	assert.Nil(t, ioutil.WriteFile(a, []byte("alpha\n"), 0600))
+
+	_, err := Init(b, 1, false)
+	assert.Nil(t, err)
+	p, err := New(b, Options{ParityBits: 1})
+	assert.Nil(t, err)
+	assert.Nil(t, p.AddDir(context.Background(), dir, dir))
+	assert.Nil(t, p.Close())
+
+	p, err = New(b, Options{ReadOnly: true, ParityBits: 1})
+	assert.Nil(t, err)
+	files, err := p.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{a}, files)
+	assert.True(t, verifyPack(t, p))
+	restored := filepath.Join(dir, "restored", "a.txt")
+	assert.Nil(t, p.Restore(context.Background(), a, restored))
+	assert.Nil(t, p.Close())
+	data, err := ioutil.ReadFile(restored)
+	assert.Nil(t, err)
+	assert.Equal(t, "alpha\n", string(data))
+
+	// damage the object; recovery restores it from its bkup
+	assert.Nil(t, putObject(raw, "d046cd9b7ffb7661e449683313d41f6fc33e3130", []byte("bravo\n")))
+	p, err = New(b, Options{ParityBits: 1})
+	assert.Nil(t, err)
+	numOK, numRecovered, numFailed, err := p.Recover(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 1, 0}, []int{numOK, numRecovered, numFailed})
+	assert.Nil(t, p.Close())
+}
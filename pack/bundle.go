@@ -0,0 +1,348 @@
+package pack
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A bundle is a single file which carries snapshots (and the objects they need) to a pack which can't be reached by
+// any backend. It consists of lines of text, each object being followed by its contents:
+//
+//	acbup bundle 1
+//	requires <sha1>                           (only for bundles created --since a snapshot)
+//	snapshot <reflog record>                  (one per snapshot, oldest first)
+//	object <sha1> <size>                      (data first, then refs)
+//	<size bytes>
+//	end <sha1 of everything before this line>
+const bundleHeader = "acbup bundle 1"
+
+// BundleOptions control which snapshots CreateBundle includes
+type BundleOptions struct {
+	// Since is the id (or a unique prefix of it) of a snapshot which the pack the bundle is applied to already has;
+	// only newer snapshots, and the objects which that snapshot doesn't reference, are included. All snapshots are
+	// included if it's empty.
+	Since string
+}
+
+// BundleStats summarizes a bundle which was created or applied
+type BundleStats struct {
+	SyncStats
+
+	// Head is the id of the newest snapshot in the bundle, which the next bundle can be created --since
+	Head string
+}
+
+// CreateBundle writes a bundle of the snapshots of the pack in from which are newer than opts.Since to w. Objects are
+// read from any intact copy, and verified as they are written.
+func CreateBundle(ctx context.Context, from Backend, w io.Writer, opts BundleOptions) (BundleStats, error) {
+	var stats BundleStats
+	src, err := openForSync(from, true)
+	if err != nil {
+		return stats, err
+	}
+	defer src.Abort()
+
+	entries, _, err := readReflog(src.backend)
+	if err != nil {
+		return stats, err
+	}
+	var requires string
+	known := map[string]bool{}
+	if opts.Since != "" {
+		i, err := findSnapshot(entries, opts.Since)
+		if err != nil {
+			return stats, err
+		}
+		requires = entries[i].sha1
+		stats.Head = requires
+		refs, err := readSnapshotRefs(src.backend, requires)
+		if err != nil {
+			return stats, fmt.Errorf("failed to read snapshot %s: %w", requires, err)
+		}
+		known[requires] = true
+		for _, ref := range refs {
+			known[ref.sha1] = true
+		}
+		entries = entries[i+1:]
+	}
+
+	var snapshots []reflogEntry
+	var data, refsObjects []string
+	for _, e := range entries {
+		err := ctx.Err()
+		if err != nil {
+			return stats, err
+		}
+		refs, err := readSnapshotRefs(src.backend, e.sha1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: skipping snapshot %s from %s: %s\n", e.sha1, e.time.Format(time.RFC3339), err)
+			stats.Skipped++
+			continue
+		}
+		snapshots = append(snapshots, e)
+		stats.Snapshots++
+		stats.Head = e.sha1
+		if !known[e.sha1] {
+			known[e.sha1] = true
+			refsObjects = append(refsObjects, e.sha1)
+		}
+		for _, ref := range refs {
+			if !known[ref.sha1] {
+				known[ref.sha1] = true
+				data = append(data, ref.sha1)
+			}
+		}
+	}
+
+	h := sha1.New()
+	bw := bufio.NewWriter(w)
+	out := io.MultiWriter(bw, h)
+	fmt.Fprintf(out, "%s\n", bundleHeader)
+	if requires != "" {
+		fmt.Fprintf(out, "requires %s\n", requires)
+	}
+	for _, e := range snapshots {
+		fmt.Fprintf(out, "snapshot %s", e)
+	}
+	for _, sha := range append(data, refsObjects...) {
+		err := ctx.Err()
+		if err != nil {
+			return stats, err
+		}
+		n, err := writeBundleObject(src.backend, out, sha)
+		if err != nil {
+			return stats, err
+		}
+		stats.Objects++
+		stats.Bytes += n
+	}
+	fmt.Fprintf(bw, "end %x\n", h.Sum(nil))
+	return stats, bw.Flush()
+}
+
+// readSnapshotRefs reads the refs of a snapshot from any intact copy
+func readSnapshotRefs(b Backend, sha1 string) ([]*refEntry, error) {
+	intact, err := intactCopies(b, sha1)
+	if err != nil {
+		return nil, err
+	}
+	if len(intact) == 0 {
+		return nil, fmt.Errorf("no intact copy of its refs exists")
+	}
+	return readRefsObject(b, intact[0])
+}
+
+// writeBundleObject writes an object (read from an intact copy) to a bundle, and returns its size
+func writeBundleObject(b Backend, w io.Writer, sha string) (int64, error) {
+	intact, err := intactCopies(b, sha)
+	if err != nil {
+		return 0, err
+	}
+	if len(intact) == 0 {
+		return 0, fmt.Errorf("no intact copy of %s exists", b.ObjectLocation(sha))
+	}
+	info, err := b.StatObject(intact[0])
+	if err != nil {
+		return 0, err
+	}
+	r, err := b.GetObject(intact[0])
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	_, err = fmt.Fprintf(w, "object %s %d\n", sha, info.Size)
+	if err != nil {
+		return 0, err
+	}
+	h := sha1.New()
+	n, err := io.Copy(io.MultiWriter(w, h), r)
+	if err != nil {
+		return n, err
+	}
+	actual := fmt.Sprintf("%x", h.Sum(nil))
+	if n != info.Size || actual != sha {
+		// the copy changed since it was verified; the bundle can't be finished, as its size has been written
+		return n, &CorruptObjectError{Path: b.ObjectLocation(intact[0]), Expected: sha, Actual: actual}
+	}
+	return n, nil
+}
+
+// bundleReader reads a bundle while computing the checksum of what has been read
+type bundleReader struct {
+	r    *bufio.Reader
+	hash hash.Hash
+
+	// checksum is the checksum of everything before the last line which was read
+	checksum string
+}
+
+// readLine returns the next line, without its newline
+func (br *bundleReader) readLine() (string, error) {
+	line, err := br.r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			return "", fmt.Errorf("bundle is truncated")
+		}
+		return "", err
+	}
+	br.checksum = fmt.Sprintf("%x", br.hash.Sum(nil))
+	br.hash.Write([]byte(line))
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+// ApplyBundle imports a bundle into the pack in to. Every object is verified before it's stored, and the snapshots are
+// only added to the reflog (and the refs pointer moved to the newest one) once the whole bundle has been checked.
+func ApplyBundle(ctx context.Context, to Backend, r io.Reader) (BundleStats, error) {
+	var stats BundleStats
+	dst, err := openForSync(to, false)
+	if err != nil {
+		return stats, err
+	}
+	defer dst.Abort()
+	dstEntries, _, err := readReflog(dst.backend)
+	if err != nil {
+		return stats, err
+	}
+
+	br := &bundleReader{r: bufio.NewReader(r), hash: sha1.New()}
+	line, err := br.readLine()
+	if err != nil {
+		return stats, err
+	}
+	if line != bundleHeader {
+		return stats, fmt.Errorf("not an acbup bundle (or one written by a newer version)")
+	}
+
+	var requires *reflogEntry
+	var snapshots []reflogEntry
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return stats, err
+		}
+		line, err := br.readLine()
+		if err != nil {
+			return stats, err
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return stats, fmt.Errorf("bundle is corrupt: malformed line %q", line)
+		}
+		switch fields[0] {
+		case "requires":
+			i, err := findSnapshot(dstEntries, fields[1])
+			if err != nil {
+				return stats, fmt.Errorf("%s doesn't have snapshot %s, which the bundle was created --since: %w", dst.backend, fields[1], ErrMissingPrerequisite)
+			}
+			prerequisite := dstEntries[i]
+			requires = &prerequisite
+			stats.Head = fields[1]
+		case "snapshot":
+			e, ok := parseReflogLine(fields[1])
+			if !ok {
+				return stats, fmt.Errorf("bundle is corrupt: malformed snapshot %q", fields[1])
+			}
+			snapshots = append(snapshots, e)
+			stats.Head = e.sha1
+		case "object":
+			n, err := applyBundleObject(dst, br, fields[1])
+			if err != nil {
+				return stats, err
+			}
+			if n >= 0 {
+				stats.Objects++
+				stats.Bytes += n
+			}
+		case "end":
+			if fields[1] != br.checksum {
+				return stats, fmt.Errorf("bundle is corrupt: its checksum doesn't match")
+			}
+			// a snapshot is matched by its id alone, as the same one may have been recorded at a different time
+			dstHistory := dstEntries
+			for _, e := range snapshots {
+				if !containsSnapshot(dstEntries, e.sha1) {
+					dstEntries = append(dstEntries, e)
+					stats.Snapshots++
+				}
+			}
+			srcHistory := snapshots
+			if requires != nil {
+				srcHistory = append([]reflogEntry{*requires}, snapshots...)
+			}
+			head := headAfterMerge(dst.head, stats.Head, dstHistory, srcHistory)
+			stats.Merged = head == ""
+			if stats.Snapshots == 0 {
+				return stats, nil
+			}
+			return stats, dst.mergeReflog(dstEntries, head, stats.Head)
+		default:
+			return stats, fmt.Errorf("bundle is corrupt: malformed line %q", line)
+		}
+	}
+}
+
+// applyBundleObject stores the object described by header (its sha1 and size) from a bundle, unless the pack already
+// has it; it returns the object's size, or -1 if it was already stored
+func applyBundleObject(p *packImp, br *bundleReader, header string) (int64, error) {
+	fields := strings.Fields(header)
+	if len(fields) != 2 || !isSha1(fields[0]) {
+		return 0, fmt.Errorf("bundle is corrupt: malformed object header %q", header)
+	}
+	sha := fields[0]
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("bundle is corrupt: malformed object header %q", header)
+	}
+	exists, err := objectExists(p.backend, sha)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		_, err = io.CopyN(br.hash, br.r, size)
+		if errors.Is(err, io.EOF) {
+			return 0, fmt.Errorf("bundle is truncated")
+		}
+		return -1, err
+	}
+
+	fmt.Fprintf(os.Stderr, "writing to %s\n", p.backend.ObjectLocation(sha))
+	w, err := p.backend.CreateObject()
+	if err != nil {
+		return 0, err
+	}
+	h := sha1.New()
+	_, err = io.CopyN(io.MultiWriter(w, h, br.hash), br.r, size)
+	if err != nil {
+		w.Abort()
+		if errors.Is(err, io.EOF) {
+			return 0, fmt.Errorf("bundle is truncated")
+		}
+		return 0, err
+	}
+	actual := fmt.Sprintf("%x", h.Sum(nil))
+	if actual != sha {
+		w.Abort()
+		return 0, fmt.Errorf("bundle is corrupt: %w", &CorruptObjectError{Path: "object " + sha, Expected: sha, Actual: actual})
+	}
+	err = w.Commit(sha)
+	if err != nil {
+		return 0, err
+	}
+	if p.parityBits == 1 {
+		err = p.createBkup(sha)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
@@ -0,0 +1,97 @@
+package pack
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// Open returns a reader of the file at path in the current snapshot; see OpenSnapshot
+func (p *packImp) Open(path string) (io.ReadCloser, error) {
+	return p.OpenSnapshot("", path)
+}
+
+// OpenSnapshot returns a reader of the file at path in a snapshot, given by its id (or a unique prefix of it); the
+// current snapshot is used if it's empty. The object is streamed straight from the pack, from the first of its copies
+// which is intact; it's verified again as it's read, and once all of it has been read, Read returns a
+// CorruptObjectError rather than io.EOF if it changed since. A symlink reads as its target.
+func (p *packImp) OpenSnapshot(snapshot, path string) (io.ReadCloser, error) {
+	refs, err := p.snapshotRefs(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	ref, ok := buildRefIndex(refs)[path]
+	if !ok {
+		return nil, fmt.Errorf("%s %w", path, ErrNotInBackup)
+	}
+	return p.OpenObject(ref.sha1)
+}
+
+// OpenObject returns a reader of the object with the given sha1, which is verified in the same way as by OpenSnapshot
+func (p *packImp) OpenObject(sha string) (io.ReadCloser, error) {
+	if !isSha1(sha) {
+		return nil, fmt.Errorf("%q is not a sha1", sha)
+	}
+	// bytes which have been handed out can't be taken back, so each copy is hashed before it's streamed: the object,
+	// its bkup (or repair copies), and then the RepairFrom packs
+	var firstErr, lastErr error
+	for _, b := range append([]Backend{p.backend}, p.repairFrom...) {
+		names, err := objectCopies(b, sha)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if lastErr != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: %s; reading %s instead\n", lastErr, b.ObjectLocation(name))
+			}
+			actual, err := hashObject(b, name)
+			if err != nil {
+				return nil, err
+			}
+			if actual != sha {
+				lastErr = &CorruptObjectError{Path: b.ObjectLocation(name), Expected: sha, Actual: actual}
+				if firstErr == nil {
+					firstErr = lastErr
+				}
+				continue
+			}
+			r, err := b.GetObject(name)
+			if err != nil {
+				return nil, err
+			}
+			return &verifyingReader{r: r, hash: sha1.New(), location: b.ObjectLocation(name), expected: sha}, nil
+		}
+	}
+	if firstErr == nil {
+		return nil, fmt.Errorf("%s: %w", p.backend.ObjectLocation(sha), os.ErrNotExist)
+	}
+	// the copy in the pack itself is the one worth reporting
+	return nil, firstErr
+}
+
+// verifyingReader hashes an object as it's read, and reports a mismatch (the object changed after it was verified) in
+// place of io.EOF
+type verifyingReader struct {
+	r        io.ReadCloser
+	hash     hash.Hash
+	location string
+	expected string
+}
+
+func (v *verifyingReader) Read(b []byte) (int, error) {
+	n, err := v.r.Read(b)
+	v.hash.Write(b[:n])
+	if err == io.EOF {
+		actual := fmt.Sprintf("%x", v.hash.Sum(nil))
+		if actual != v.expected {
+			return n, &CorruptObjectError{Path: v.location, Expected: v.expected, Actual: actual}
+		}
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.r.Close()
+}
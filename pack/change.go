@@ -0,0 +1,196 @@
+package pack
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ChangePolicy decides what happens to a file which changes while it is being stored
+type ChangePolicy int
+
+const (
+	// ChangeRetry copies the file again, up to Options.ChangeRetries more times; if it is still changing after
+	// that, it is stored as read
+	ChangeRetry ChangePolicy = iota
+	// ChangeStoreAsRead stores whatever was read, even though it may not match any state the file was ever in
+	ChangeStoreAsRead
+	// ChangeSkip leaves the file out of the snapshot (keeping any previously backed up version)
+	ChangeSkip
+	// ChangeFail stops the backup with a SourceChangedError
+	ChangeFail
+)
+
+var changePolicyNames = map[ChangePolicy]string{
+	ChangeRetry:       "retry",
+	ChangeStoreAsRead: "store-as-read",
+	ChangeSkip:        "skip",
+	ChangeFail:        "fail",
+}
+
+func (c ChangePolicy) String() string {
+	return changePolicyNames[c]
+}
+
+// ParseChangePolicy parses the name of a ChangePolicy (e.g. "retry")
+func ParseChangePolicy(s string) (ChangePolicy, error) {
+	for c, name := range changePolicyNames {
+		if name == s {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown change policy %q; must be one of retry, store-as-read, skip, or fail", s)
+}
+
+// VolatileFile describes a file which changed while it was being stored
+type VolatileFile struct {
+	Path     string
+	Attempts int
+	Stored   bool
+}
+
+// stagedFile is a copy of a file which has been written to a temporary object in each of several backends, but not
+// yet committed; a backend which fails is recorded in errs (leaving a nil writer), while the others carry on
+type stagedFile struct {
+	objs []ObjectWriter
+	errs []error
+	hash string
+	n    int64
+}
+
+func (s *stagedFile) Write(p []byte) (int, error) {
+	for i, obj := range s.objs {
+		if obj == nil {
+			continue
+		}
+		_, err := obj.Write(p)
+		if err != nil {
+			obj.Abort()
+			s.objs[i] = nil
+			s.errs[i] = err
+		}
+	}
+	return len(p), nil
+}
+
+func (s *stagedFile) abort() {
+	for _, obj := range s.objs {
+		if obj != nil {
+			obj.Abort()
+		}
+	}
+}
+
+// stageFile copies up to size bytes of src into a temporary object in each backend in a single pass (so a growing
+// file is read as the prefix which existed when it was stat'ed); the copies aren't committed, since their name
+// depends on the hash of what was actually read
+func stageFile(backends []Backend, src string, size int64) (*stagedFile, error) {
+	const bufferSize = 1024 * 1024 * 16
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer srcFile.Close()
+
+	s := &stagedFile{
+		objs: make([]ObjectWriter, len(backends)),
+		errs: make([]error, len(backends)),
+	}
+	for i, b := range backends {
+		s.objs[i], s.errs[i] = b.CreateObject()
+	}
+	h := sha1.New()
+	s.n, err = io.CopyBuffer(io.MultiWriter(s, h), io.LimitReader(srcFile, size), make([]byte, bufferSize))
+	if err != nil {
+		s.abort()
+		return nil, err
+	}
+	s.hash = fmt.Sprintf("%x", h.Sum(nil))
+	return s, nil
+}
+
+// commit commits each pack's staged copy, returning the error of each pack
+func (s *stagedFile) commit(packs []*packImp, alias, pathAndAlias string, size, modTime int64) []error {
+	for i, p := range packs {
+		if s.objs[i] != nil {
+			s.errs[i] = p.commitStaged(s.objs[i], s.hash, alias, pathAndAlias, size, modTime)
+		}
+	}
+	return s.errs
+}
+
+// storeFile stages a copy of path and commits it under the hash of what was read; if the file changed while it was
+// being read, the configured ChangePolicy decides what happens
+func (p *packImp) storeFile(path, alias, pathAndAlias string, before os.FileInfo) error {
+	volatile, errs, err := storeFileInPacks([]*packImp{p}, path, alias, pathAndAlias, before)
+	if volatile != nil {
+		p.volatile = append(p.volatile, *volatile)
+	}
+	if err != nil {
+		return err
+	}
+	return errs[0]
+}
+
+// storeFileInPacks stores path in several packs while reading it only once; errs holds the error of each pack, while
+// err is set if the file couldn't be read (or changed, under ChangeFail). The returned VolatileFile is set if the
+// file changed while it was being read. The ChangePolicy of the first pack applies.
+func storeFileInPacks(packs []*packImp, path, alias, pathAndAlias string, before os.FileInfo) (*VolatileFile, []error, error) {
+	backends := make([]Backend, len(packs))
+	for i, p := range packs {
+		backends[i] = p.backend
+	}
+	for attempt := 1; ; attempt++ {
+		staged, err := stageFile(backends, path, before.Size())
+		if err != nil {
+			return nil, nil, err
+		}
+		after, err := os.Stat(path)
+		if err != nil {
+			staged.abort()
+			return nil, nil, err
+		}
+		size := before.Size()
+		modTime := before.ModTime().UnixNano()
+		changed := staged.n != size || after.Size() != size || !after.ModTime().Equal(before.ModTime())
+		if !changed {
+			var volatile *VolatileFile
+			if attempt > 1 {
+				volatile = &VolatileFile{Path: alias, Attempts: attempt, Stored: true}
+			}
+			return volatile, staged.commit(packs, alias, pathAndAlias, size, modTime), nil
+		}
+
+		policy := packs[0].onChange
+		if policy == ChangeRetry {
+			if attempt <= packs[0].changeRetries {
+				staged.abort()
+				fmt.Fprintf(os.Stderr, "WARNING: %s changed while it was being backed up; retrying\n", pathAndAlias)
+				before = after
+				continue
+			}
+			policy = ChangeStoreAsRead
+		}
+
+		switch policy {
+		case ChangeSkip:
+			staged.abort()
+			fmt.Fprintf(os.Stderr, "WARNING: %s changed while it was being backed up; skipping it\n", pathAndAlias)
+			return &VolatileFile{Path: alias, Attempts: attempt}, make([]error, len(packs)), nil
+		case ChangeFail:
+			staged.abort()
+			return &VolatileFile{Path: alias, Attempts: attempt}, nil, &SourceChangedError{Path: path, Attempts: attempt}
+		default:
+			fmt.Fprintf(os.Stderr, "WARNING: %s changed while it was being backed up; storing it as read\n", pathAndAlias)
+			// what was read doesn't correspond to the file's size and modification time, so don't record them
+			// (which would let a resumed backup skip re-hashing it)
+			return &VolatileFile{Path: alias, Attempts: attempt, Stored: true}, staged.commit(packs, alias, pathAndAlias, -1, -1), nil
+		}
+	}
+}
+
+// VolatileFiles returns the files which changed while they were being stored
+func (p *packImp) VolatileFiles() []VolatileFile {
+	return p.volatile
+}
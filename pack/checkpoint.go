@@ -0,0 +1,66 @@
+package pack
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Checkpoint writes a snapshot of everything added so far, marked as partial. The next backup of a pack whose
+// latest snapshot is partial skips re-hashing files which were recorded since the last complete snapshot, and
+// haven't changed since.
+func (p *packImp) Checkpoint() error {
+	fmt.Fprintf(os.Stderr, "writing checkpoint\n")
+	err := p.writeRefs(p.refs, true)
+	if err != nil {
+		return err
+	}
+	p.filesSinceCheckpoint = 0
+	p.lastCheckpoint = time.Now()
+	return nil
+}
+
+// maybeCheckpoint writes a checkpoint once enough files have been added, or enough time has passed, since the last one
+func (p *packImp) maybeCheckpoint() error {
+	p.filesSinceCheckpoint++
+	if p.checkpointFiles > 0 && p.filesSinceCheckpoint >= p.checkpointFiles {
+		return p.Checkpoint()
+	}
+	if p.checkpointInterval > 0 && time.Since(p.lastCheckpoint) >= p.checkpointInterval {
+		return p.Checkpoint()
+	}
+	return nil
+}
+
+// resumedPaths returns the paths of refs (the refs of the partial snapshot head) which were recorded since the last
+// complete snapshot, i.e. by interrupted runs; files recorded by an earlier complete snapshot are left out, as they
+// must still be hashed and checked against their stored copies
+func resumedPaths(b Backend, head string, refs []*refEntry) (map[string]bool, error) {
+	entries, _, err := readReflog(b)
+	if err != nil {
+		return nil, err
+	}
+	var complete map[string]*refEntry
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].partial {
+			continue
+		}
+		completeRefs, err := readSnapshotRefs(b, entries[i].sha1)
+		if err != nil {
+			// which files the interrupted runs recorded can't be told apart, so they're all re-hashed
+			fmt.Fprintf(os.Stderr, "WARNING: failed to read snapshot %s: %s; not resuming the interrupted backup\n", entries[i].sha1, err)
+			return nil, nil
+		}
+		complete = buildRefIndex(completeRefs)
+		break
+	}
+
+	resumed := map[string]bool{}
+	for _, ref := range refs {
+		prev, ok := complete[ref.path]
+		if !ok || prev.sha1 != ref.sha1 || prev.size != ref.size || prev.modTime != ref.modTime {
+			resumed[ref.path] = true
+		}
+	}
+	return resumed, nil
+}
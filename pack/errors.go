@@ -0,0 +1,80 @@
+package pack
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrCorruptObject is returned when a stored object's contents don't match its hash
+	ErrCorruptObject = errors.New("corrupt object")
+
+	// ErrSourceChanged is returned when a file changes while it is being backed up
+	ErrSourceChanged = errors.New("source changed while it was being backed up")
+
+	// ErrRefsCorrupt is returned when the refs of a pack can't be read or don't make sense
+	ErrRefsCorrupt = errors.New("refs are corrupt")
+
+	// ErrNotInBackup is returned when a path isn't recorded in the pack
+	ErrNotInBackup = errors.New("not in backup")
+
+	// ErrUnknownSnapshot is returned when a snapshot id doesn't match any snapshot in the reflog
+	ErrUnknownSnapshot = errors.New("no such snapshot")
+
+	// ErrMissingPrerequisite is returned when a bundle is applied to a pack which lacks the snapshot it was created
+	// --since
+	ErrMissingPrerequisite = errors.New("pack lacks the bundle's prerequisite snapshot")
+
+	// ErrWriteProtected can be returned (or wrapped) by a backend whose storage is write-protected, like a read-only
+	// mount (which is reported as EROFS); such a pack is read without a lock
+	ErrWriteProtected = errors.New("write-protected")
+
+	// ErrAllPacksFailed is returned by Mirror once there's no pack left to back up to
+	ErrAllPacksFailed = errors.New("backup to every destination failed")
+)
+
+// CorruptObjectError describes an object whose contents don't match its hash; it matches ErrCorruptObject
+type CorruptObjectError struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (e *CorruptObjectError) Error() string {
+	return fmt.Sprintf("%s is corrupt; should be %s but instead is %s", e.Path, e.Expected, e.Actual)
+}
+
+// Is reports whether target is ErrCorruptObject
+func (e *CorruptObjectError) Is(target error) bool {
+	return target == ErrCorruptObject
+}
+
+// SourceChangedError describes a file which changed while it was being stored; it matches ErrSourceChanged
+type SourceChangedError struct {
+	Path     string
+	Attempts int
+}
+
+func (e *SourceChangedError) Error() string {
+	return fmt.Sprintf("%s changed while it was being backed up (%d attempt(s))", e.Path, e.Attempts)
+}
+
+// Is reports whether target is ErrSourceChanged
+func (e *SourceChangedError) Is(target error) bool {
+	return target == ErrSourceChanged
+}
+
+// RefsCorruptError describes a refs file which can't be used; it matches ErrRefsCorrupt
+type RefsCorruptError struct {
+	Path   string
+	Reason string
+}
+
+func (e *RefsCorruptError) Error() string {
+	return fmt.Sprintf("detected corruption in %s while reading refs: %s", e.Path, e.Reason)
+}
+
+// Is reports whether target is ErrRefsCorrupt
+func (e *RefsCorruptError) Is(target error) bool {
+	return target == ErrRefsCorrupt
+}
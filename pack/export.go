@@ -0,0 +1,275 @@
+package pack
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExportFormat is the archive format which Export writes
+type ExportFormat string
+
+// the formats which Export supports
+const (
+	ExportTar   ExportFormat = "tar"
+	ExportTarGz ExportFormat = "tar.gz"
+	ExportZip   ExportFormat = "zip"
+)
+
+// ExportOptions control what Export writes
+type ExportOptions struct {
+	// Snapshot is the id (or a unique prefix of it) of the snapshot to export; the current one is exported if it's
+	// empty
+	Snapshot string
+
+	Format ExportFormat
+
+	// Prefix limits the export to the file or dir at this path; archive entries are named relative to it
+	Prefix string
+}
+
+// ExportStats summarizes what Export wrote
+type ExportStats struct {
+	Files int
+	Bytes int64
+}
+
+// archiveWriter is implemented for each ExportFormat
+type archiveWriter interface {
+	// create starts the next file, which must then be written in full
+	create(name string, size int64, modTime time.Time, perm os.FileMode) (io.Writer, error)
+	symlink(name, target string, modTime time.Time) error
+	Close() error
+}
+
+// Export writes the files of a snapshot of the pack in b to w as an archive. Objects are streamed straight from the
+// pack, so nothing is buffered; a corrupt object is exported from an intact copy of it instead, and Export fails
+// (leaving the archive unfinished) if no intact copy exists.
+func Export(ctx context.Context, b Backend, w io.Writer, opts ExportOptions) (ExportStats, error) {
+	var stats ExportStats
+	src, err := openForSync(b, true)
+	if err != nil {
+		return stats, err
+	}
+	defer src.Abort()
+
+	refs, err := src.snapshotRefs(opts.Snapshot)
+	if err != nil {
+		return stats, err
+	}
+
+	prefix := "/"
+	if opts.Prefix != "" {
+		prefix = path.Clean("/" + opts.Prefix)
+	}
+	index := buildRefIndex(refs)
+	var paths []string
+	for p := range index {
+		if exportName(p, prefix) != "" {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		return stats, fmt.Errorf("%s %w", prefix, ErrNotInBackup)
+	}
+	sort.Strings(paths)
+
+	var aw archiveWriter
+	switch opts.Format {
+	case ExportTar:
+		aw = &tarArchive{tw: tar.NewWriter(w)}
+	case ExportTarGz:
+		gw := gzip.NewWriter(w)
+		aw = &tarArchive{tw: tar.NewWriter(gw), gw: gw}
+	case ExportZip:
+		aw = &zipArchive{zw: zip.NewWriter(w)}
+	default:
+		return stats, fmt.Errorf("unsupported export format %q (must be %s, %s, or %s)", opts.Format, ExportTar, ExportTarGz, ExportZip)
+	}
+
+	for _, p := range paths {
+		err := ctx.Err()
+		if err != nil {
+			return stats, err
+		}
+		ref := index[p]
+		n, err := exportObject(src.backend, aw, exportName(p, prefix), ref)
+		if err != nil {
+			return stats, err
+		}
+		fmt.Fprintf(os.Stderr, "exported %s\n", ref.path)
+		stats.Files++
+		stats.Bytes += n
+	}
+	return stats, aw.Close()
+}
+
+// exportName returns the name under which the file at p is exported, or "" if it isn't under prefix
+func exportName(p, prefix string) string {
+	if p == prefix {
+		return path.Base(p)
+	}
+	if prefix == "/" {
+		return strings.TrimPrefix(p, "/")
+	}
+	if !strings.HasPrefix(p, prefix+"/") {
+		return ""
+	}
+	return p[len(prefix)+1:]
+}
+
+// exportObject writes the object which ref refers to into an archive, from an intact copy of it (the object itself,
+// its .bkup, or a repair copy), verifying it on the way
+func exportObject(b Backend, aw archiveWriter, name string, ref *refEntry) (int64, error) {
+	intact, err := intactCopies(b, ref.sha1)
+	if err != nil {
+		return 0, err
+	}
+	if len(intact) == 0 {
+		return 0, &CorruptObjectError{Path: b.ObjectLocation(ref.sha1), Expected: ref.sha1, Actual: "no intact copy"}
+	}
+	copyName := intact[0]
+
+	if ref.isSymlink() {
+		// the target is needed for the header, so it's read (and verified) first
+		var target bytes.Buffer
+		_, err := exportVerified(b, &target, copyName, ref.sha1)
+		if err != nil {
+			return 0, err
+		}
+		return 0, aw.symlink(name, target.String(), time.Unix(0, ref.modTime))
+	}
+
+	size := ref.size
+	modTime := time.Now()
+	if size < 0 {
+		info, err := b.StatObject(copyName)
+		if err != nil {
+			return 0, err
+		}
+		size = info.Size
+	} else {
+		modTime = time.Unix(0, ref.modTime)
+	}
+
+	fw, err := aw.create(name, size, modTime, ref.perm())
+	if err != nil {
+		return 0, err
+	}
+	n, err := exportVerified(b, fw, copyName, ref.sha1)
+	if err != nil {
+		return n, err
+	}
+	if n != size {
+		return n, fmt.Errorf("%s holds %d bytes, but %s was recorded with %d", b.ObjectLocation(copyName), n, ref.path, size)
+	}
+	return n, nil
+}
+
+// exportVerified copies the object (or copy of it) called name into w, and returns an error once it's copied if it
+// doesn't hash to sha
+func exportVerified(b Backend, w io.Writer, name, sha string) (int64, error) {
+	r, err := b.GetObject(name)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	h := sha1.New()
+	n, err := io.Copy(io.MultiWriter(w, h), r)
+	if err != nil {
+		return n, err
+	}
+	actual := fmt.Sprintf("%x", h.Sum(nil))
+	if actual != sha {
+		// the copy changed since it was verified
+		return n, &CorruptObjectError{Path: b.ObjectLocation(name), Expected: sha, Actual: actual}
+	}
+	return n, nil
+}
+
+type tarArchive struct {
+	tw *tar.Writer
+	gw *gzip.Writer
+}
+
+func (a *tarArchive) create(name string, size int64, modTime time.Time, perm os.FileMode) (io.Writer, error) {
+	err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(perm),
+		Size:     size,
+		ModTime:  modTime,
+		Format:   tar.FormatPAX,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a.tw, nil
+}
+
+func (a *tarArchive) symlink(name, target string, modTime time.Time) error {
+	return a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     name,
+		Linkname: target,
+		Mode:     0777,
+		ModTime:  modTime,
+		Format:   tar.FormatPAX,
+	})
+}
+
+func (a *tarArchive) Close() error {
+	err := a.tw.Close()
+	if err != nil {
+		return err
+	}
+	if a.gw != nil {
+		return a.gw.Close()
+	}
+	return nil
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) create(name string, size int64, modTime time.Time, perm os.FileMode) (io.Writer, error) {
+	fh := &zip.FileHeader{
+		Name:               name,
+		Method:             zip.Deflate,
+		Modified:           modTime,
+		UncompressedSize64: uint64(size),
+	}
+	fh.SetMode(perm)
+	return a.zw.CreateHeader(fh)
+}
+
+// symlink stores a symlink the way Info-ZIP does: as an entry with the symlink mode, holding the target
+func (a *zipArchive) symlink(name, target string, modTime time.Time) error {
+	fh := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: modTime,
+	}
+	fh.SetMode(os.ModeSymlink | 0777)
+	w, err := a.zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, target)
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
@@ -0,0 +1,271 @@
+package pack
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// httpBackend stores a pack on a server started with `acbup serve`
+type httpBackend struct {
+	base   *url.URL
+	token  string
+	client *http.Client
+}
+
+// NewHTTPBackend returns a backend which stores a pack on the acbup server at baseURL, authenticating with token
+// (if it isn't empty)
+func NewHTTPBackend(baseURL, token string, client *http.Client) (Backend, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported url %s", baseURL)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpBackend{base: u, token: token, client: client}, nil
+}
+
+// newHTTPBackendFromURL returns a backend for dst, taking the token from ACBUP_TOKEN
+func newHTTPBackendFromURL(dst string) (Backend, error) {
+	return NewHTTPBackend(dst, os.Getenv("ACBUP_TOKEN"), nil)
+}
+
+func (b *httpBackend) String() string {
+	return b.base.String()
+}
+
+func (b *httpBackend) ObjectLocation(name string) string {
+	return b.url(httpObjectsPath+name, nil)
+}
+
+func (b *httpBackend) url(p string, query url.Values) string {
+	u := b.base.ResolveReference(&url.URL{Path: p})
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// httpError is an error response from an acbup server
+type httpError struct {
+	StatusCode int
+	Message    string
+	method     string
+	url        string
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("%s %s failed with status %d: %s", e.method, e.url, e.StatusCode, e.Message)
+}
+
+func (e *httpError) Is(target error) bool {
+	switch target {
+	case os.ErrNotExist:
+		return e.StatusCode == http.StatusNotFound
+	case os.ErrPermission:
+		return e.StatusCode == http.StatusForbidden || e.StatusCode == http.StatusUnauthorized
+	}
+	return false
+}
+
+func isHTTPStatus(err error, code int) bool {
+	var he *httpError
+	return errors.As(err, &he) && he.StatusCode == code
+}
+
+// do sends a request; responses other than 2xx are returned as an *httpError, and the caller must close the body
+// of successful responses
+func (b *httpBackend) do(method, p string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u := b.url(p, query)
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		return nil, &httpError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg)), method: method, url: u}
+	}
+	return resp, nil
+}
+
+func (b *httpBackend) getJSON(p string, query url.Values, v interface{}) error {
+	resp, err := b.do(http.MethodGet, p, query, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (b *httpBackend) head(name, p string) (Info, error) {
+	resp, err := b.do(http.MethodHead, p, nil, nil, nil, 0)
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+	info := Info{Name: name, Size: resp.ContentLength}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return info, nil
+}
+
+func (b *httpBackend) put(p string, header http.Header, body io.Reader, size int64) error {
+	resp, err := b.do(http.MethodPut, p, nil, header, body, size)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b *httpBackend) delete(p string) error {
+	resp, err := b.do(http.MethodDelete, p, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// httpObjectWriter spools an object to a local temporary file, since it can only be uploaded once its name is
+// known
+type httpObjectWriter struct {
+	f *os.File
+	b *httpBackend
+}
+
+func (b *httpBackend) CreateObject() (ObjectWriter, error) {
+	f, err := ioutil.TempFile("", "acbup-http-")
+	if err != nil {
+		return nil, err
+	}
+	return &httpObjectWriter{f: f, b: b}, nil
+}
+
+func (w *httpObjectWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+func (w *httpObjectWriter) Commit(name string) error {
+	defer w.Abort()
+	size, err := w.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	_, err = w.f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return w.b.put(httpObjectsPath+name, nil, w.f, size)
+}
+
+func (w *httpObjectWriter) Abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+func (b *httpBackend) GetObject(name string) (io.ReadCloser, error) {
+	resp, err := b.do(http.MethodGet, httpObjectsPath+name, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b *httpBackend) StatObject(name string) (Info, error) {
+	return b.head(name, httpObjectsPath+name)
+}
+
+func (b *httpBackend) ListObjects() ([]Info, error) {
+	var objects []Info
+	err := b.getJSON(httpObjectsPath, nil, &objects)
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (b *httpBackend) DeleteObject(name string) error {
+	return b.delete(httpObjectsPath + name)
+}
+
+func (b *httpBackend) ReadFile(name string) ([]byte, error) {
+	resp, err := b.do(http.MethodGet, httpFilesPath+name, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (b *httpBackend) StatFile(name string) (Info, error) {
+	return b.head(name, httpFilesPath+name)
+}
+
+func (b *httpBackend) WriteFile(name string, data []byte) error {
+	return b.put(httpFilesPath+name, nil, bytes.NewReader(data), int64(len(data)))
+}
+
+func (b *httpBackend) CreateFile(name string, data []byte) error {
+	err := b.put(httpFilesPath+name, http.Header{"If-None-Match": {"*"}}, bytes.NewReader(data), int64(len(data)))
+	if isHTTPStatus(err, http.StatusPreconditionFailed) {
+		return &os.PathError{Op: "create", Path: name, Err: os.ErrExist}
+	}
+	return err
+}
+
+// SwapFile is performed atomically by the server
+func (b *httpBackend) SwapFile(name string, old, data []byte) error {
+	header := http.Header{}
+	if old == nil {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", fmt.Sprintf("\"%x\"", sha1.Sum(old)))
+	}
+	err := b.put(httpFilesPath+name, header, bytes.NewReader(data), int64(len(data)))
+	if isHTTPStatus(err, http.StatusPreconditionFailed) {
+		return ErrSwapConflict
+	}
+	return err
+}
+
+func (b *httpBackend) RemoveFile(name string) error {
+	err := b.delete(httpFilesPath + name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (b *httpBackend) ListFiles(prefix string) ([]string, error) {
+	var names []string
+	err := b.getJSON(httpFilesPath, url.Values{"prefix": {prefix}}, &names)
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
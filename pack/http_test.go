@@ -0,0 +1,113 @@
+package pack
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestHTTPBackend serves b (under a path, as it would be behind a reverse proxy) and returns a client backend
+// for it
+func newTestHTTPBackend(t *testing.T, b Backend, opts ServerOptions) Backend {
+	server := httptest.NewServer(http.StripPrefix("/pack", NewServer(b, opts)))
+	t.Cleanup(server.Close)
+	client, err := NewHTTPBackend(server.URL+"/pack", opts.Token, nil)
+	assert.Nil(t, err)
+	return client
+}
+
+func TestHTTPBackend(t *testing.T) {
+	opts := ServerOptions{Token: "secret"}
+	testBackend(t, newTestHTTPBackend(t, NewMemoryBackend(), opts))
+	b := NewMemoryBackend()
+	testBackendPack(t, newTestHTTPBackend(t, b, opts), b)
+
+	root := t.TempDir()
+	testBackendPack(t, newTestHTTPBackend(t, NewLocalBackend(root), opts), NewLocalBackend(root))
+	p, err := New(NewLocalBackend(root), Options{ReadOnly: true, ParityBits: 1})
+	assert.Nil(t, err)
+	assert.True(t, verifyPack(t, p))
+	assert.Nil(t, p.Close())
+}
+
+func TestHTTPServerChecks(t *testing.T) {
+	b := NewMemoryBackend()
+	server := httptest.NewServer(NewServer(b, ServerOptions{Token: "secret"}))
+	defer server.Close()
+
+	unauthorized, err := NewHTTPBackend(server.URL, "wrong", nil)
+	assert.Nil(t, err)
+	_, err = unauthorized.ReadFile("meta")
+	assert.True(t, errors.Is(err, os.ErrPermission), "got %v", err)
+
+	client, err := NewHTTPBackend(server.URL, "secret", nil)
+	assert.Nil(t, err)
+
+	// uploads are rejected unless their contents match their name
+	name := strings.Repeat("ab", 20)
+	err = putObject(client, name, []byte("not ab...ab"))
+	assert.True(t, isHTTPStatus(err, http.StatusBadRequest), "got %v", err)
+	ok, err := objectExists(b, name)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	for _, name := range []string{"../meta", "data/ab/ab/" + name, "tmp/x", "locks/../../x", "/refs"} {
+		err := client.WriteFile(name, []byte("x"))
+		assert.NotNil(t, err, "%s", name)
+	}
+	for _, name := range []string{"ab", name + ".tmp", "../" + name} {
+		_, err := client.StatObject(name)
+		assert.NotNil(t, err, "%s", name)
+	}
+}
+
+func TestHTTPAppendOnly(t *testing.T) {
+	dir := t.TempDir()
+	b := NewMemoryBackend()
+	client := newTestHTTPBackend(t, b, ServerOptions{AppendOnly: true})
+
+	// backups (and checkpoints) only ever add to the pack
+	_, err := Init(client, 1, false)
+	assert.Nil(t, err)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0600))
+		p, err := New(client, Options{ParityBits: 1})
+		assert.Nil(t, err)
+		assert.Nil(t, p.AddDir(context.Background(), dir, dir))
+		assert.Nil(t, p.Checkpoint())
+		assert.Nil(t, p.Close())
+	}
+	p, err := New(client, Options{ReadOnly: true, ParityBits: 1})
+	assert.Nil(t, err)
+	assert.True(t, verifyPack(t, p))
+	assert.Nil(t, p.Close())
+
+	// but history can't be removed or rewritten
+	objects, err := client.ListObjects()
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(client.DeleteObject(objects[0].Name), os.ErrPermission))
+	assert.True(t, errors.Is(client.WriteFile(metaFileName, []byte("version=2\n")), os.ErrPermission))
+	assert.True(t, errors.Is(client.RemoveFile(refsFileName), os.ErrPermission))
+	assert.True(t, errors.Is(client.WriteFile(reflogCopies[0], nil), os.ErrPermission))
+	assert.True(t, errors.Is(client.WriteFile("other", nil), os.ErrPermission))
+	pointer, err := client.ReadFile(refsFileName)
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(client.SwapFile(refsFileName, pointer, []byte(strings.Repeat("ab", 20))), os.ErrPermission))
+	// refs can be moved to other stored refs, but not to a data object, which would make them unreadable
+	assert.True(t, errors.Is(client.SwapFile(refsFileName, pointer, []byte("cfc7b4885384957ae445bc14914d4588f607651c")), os.ErrPermission))
+	entries, _, err := readReflog(client)
+	assert.Nil(t, err)
+	assert.Nil(t, client.SwapFile(refsFileName, pointer, []byte(entries[0].sha1)))
+
+	// locks are still managed by clients
+	assert.Nil(t, client.CreateFile("locks/shared.1", []byte("1")))
+	assert.Nil(t, client.RemoveFile("locks/shared.1"))
+}
@@ -0,0 +1,185 @@
+package pack
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ImportOptions control how ImportTar records an archive
+type ImportOptions struct {
+	// Alias is the path under which the archive's entries are recorded
+	Alias string
+
+	// Time dates the snapshot (e.g. the archive's modification time); it defaults to now
+	Time time.Time
+}
+
+// ImportStats summarizes what ImportTar recorded
+type ImportStats struct {
+	Files int
+	Bytes int64
+
+	// Skipped counts the entries (such as devices) which can't be recorded
+	Skipped int
+
+	// Snapshot is the id of the new snapshot
+	Snapshot string
+}
+
+// ImportTar records the files and symlinks of a tar archive (which may be gzipped) as a snapshot of their own,
+// dated opts.Time, in the pack in to; their modes and modification times are kept. The refs pointer is only moved to
+// the new snapshot if it's newer than every other snapshot, so old archives are added to the history without
+// replacing the current snapshot.
+func ImportTar(ctx context.Context, to Backend, r io.Reader, opts ImportOptions) (ImportStats, error) {
+	var stats ImportStats
+	if !strings.HasPrefix(opts.Alias, "/") {
+		return stats, fmt.Errorf("alias must start with /")
+	}
+	if opts.Time.IsZero() {
+		opts.Time = time.Now()
+	}
+	p, err := openForSync(to, false)
+	if err != nil {
+		return stats, err
+	}
+	defer p.Abort()
+
+	// the archive becomes a snapshot of its own, rather than being added to the current one
+	p.refs = nil
+	p.refIndex = map[string]*refEntry{}
+
+	br := bufio.NewReader(r)
+	var src io.Reader = br
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return stats, err
+		}
+		defer gr.Close()
+		src = gr
+	}
+
+	tr := tar.NewReader(src)
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return stats, err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		alias := importName(opts.Alias, hdr.Name)
+		pathAndAlias := describePath(hdr.Name, alias)
+		modTime := hdr.ModTime.UnixNano()
+		perm := hdr.Mode & 0777
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			err = p.importObject(tr, alias, pathAndAlias, modTime, modeRegular|perm)
+		case tar.TypeSymlink:
+			err = p.importObject(strings.NewReader(hdr.Linkname), alias, pathAndAlias, modTime, modeSymlink|perm)
+		case tar.TypeLink:
+			target, ok := p.refIndex[importName(opts.Alias, hdr.Linkname)]
+			if !ok {
+				fmt.Fprintf(os.Stderr, "WARNING: skipping %s: it's a hard link to %s, which isn't in the archive\n", hdr.Name, hdr.Linkname)
+				stats.Skipped++
+				continue
+			}
+			p.forget(alias)
+			err = p.addMeta(alias, target.sha1, target.size, modTime)
+			if err == nil {
+				p.refIndex[alias].mode = target.mode
+			}
+		case tar.TypeDir:
+			continue
+		default:
+			fmt.Fprintf(os.Stderr, "WARNING: skipping %s: entries of type %q can't be recorded\n", hdr.Name, hdr.Typeflag)
+			stats.Skipped++
+			continue
+		}
+		if err != nil {
+			return stats, err
+		}
+	}
+	if len(p.refs) == 0 {
+		return stats, fmt.Errorf("archive contains no files")
+	}
+	for _, ref := range p.refs {
+		stats.Files++
+		stats.Bytes += ref.size
+	}
+
+	stats.Snapshot, err = p.storeRefs(p.refs)
+	if err != nil {
+		return stats, err
+	}
+	entries, _, err := readReflog(p.backend)
+	if err != nil {
+		return stats, err
+	}
+	e := reflogEntry{sha1: stats.Snapshot, time: time.Unix(opts.Time.Unix(), 0)}
+	if !containsReflogEntry(entries, e) {
+		entries = append(entries, e)
+	}
+	// the refs pointer only moves to the imported snapshot if it's the newest one
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].time.Before(entries[j].time)
+	})
+	return stats, p.mergeReflog(entries, entries[len(entries)-1].sha1, "")
+}
+
+// importName returns the path under which an archive entry is recorded
+func importName(alias, name string) string {
+	return path.Join(alias, path.Clean("/"+name))
+}
+
+// importObject stores the contents of an archive entry, and records it
+func (p *packImp) importObject(r io.Reader, alias, pathAndAlias string, modTime, mode int64) error {
+	w, err := p.backend.CreateObject()
+	if err != nil {
+		return err
+	}
+	h := sha1.New()
+	n, err := io.Copy(io.MultiWriter(w, h), r)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	// a later entry for the same path replaces an earlier one, as it would when the archive is extracted
+	p.forget(alias)
+	err = p.commitStaged(w, fmt.Sprintf("%x", h.Sum(nil)), alias, pathAndAlias, n, modTime)
+	if err != nil {
+		return err
+	}
+	p.refIndex[alias].mode = mode
+	return nil
+}
+
+// forget removes the entry for path from the refs being written
+func (p *packImp) forget(path string) {
+	if _, ok := p.refIndex[path]; !ok {
+		return
+	}
+	delete(p.refIndex, path)
+	refs := p.refs[:0]
+	for _, ref := range p.refs {
+		if ref.path != path {
+			refs = append(refs, ref)
+		}
+	}
+	p.refs = refs
+}
@@ -0,0 +1,234 @@
+package pack
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// localBackend stores a pack in a local directory; objects are stored under data/xx/yy/<name>
+type localBackend struct {
+	root string
+
+	// sealed makes objects read-only once they are written
+	sealed bool
+}
+
+// NewLocalBackend returns a backend which stores a pack in the directory root
+func NewLocalBackend(root string) Backend {
+	return &localBackend{root: root}
+}
+
+func (b *localBackend) sealObjects() {
+	b.sealed = true
+}
+
+func (b *localBackend) String() string {
+	return b.root
+}
+
+func (b *localBackend) objectPath(name string) (string, error) {
+	if len(name) < 40 || !isSha1(name[:40]) {
+		return "", fmt.Errorf("invalid object name %q", name)
+	}
+	p, err := getShaPath(b.root, name[:40], false)
+	if err != nil {
+		return "", err
+	}
+	return p + name[40:], nil
+}
+
+func (b *localBackend) ObjectLocation(name string) string {
+	p, err := b.objectPath(name)
+	if err != nil {
+		return name
+	}
+	return p
+}
+
+func (b *localBackend) filePath(name string) string {
+	return filepath.Join(b.root, filepath.FromSlash(name))
+}
+
+type localObjectWriter struct {
+	*atomicFile
+	b *localBackend
+}
+
+func (w *localObjectWriter) Commit(name string) error {
+	dst, err := w.b.objectPath(name)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	w.dst = dst
+	if w.b.sealed {
+		err = w.f.Chmod(0400)
+		if err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	return w.atomicFile.Commit()
+}
+
+func (b *localBackend) CreateObject() (ObjectWriter, error) {
+	a, err := createAtomic(b.root, filepath.Join(b.root, "data", "object"))
+	if err != nil {
+		return nil, err
+	}
+	return &localObjectWriter{atomicFile: a, b: b}, nil
+}
+
+func (b *localBackend) GetObject(name string) (io.ReadCloser, error) {
+	p, err := b.objectPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (b *localBackend) StatObject(name string) (Info, error) {
+	p, err := b.objectPath(name)
+	if err != nil {
+		return Info{}, err
+	}
+	return statInfo(name, p)
+}
+
+func (b *localBackend) ListObjects() ([]Info, error) {
+	dataRoot := filepath.Join(b.root, "data")
+	var objects []Info
+	err := filepath.Walk(dataRoot,
+		func(walkPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && walkPath == dataRoot {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			name := filepath.Base(walkPath)
+			if p, err := b.objectPath(name); err != nil || p != walkPath {
+				fmt.Fprintf(os.Stderr, "ignoring unexpected file %s\n", walkPath)
+				return nil
+			}
+			objects = append(objects, Info{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (b *localBackend) DeleteObject(name string) error {
+	p, err := b.objectPath(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (b *localBackend) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(b.filePath(name))
+}
+
+func (b *localBackend) StatFile(name string) (Info, error) {
+	return statInfo(name, b.filePath(name))
+}
+
+func (b *localBackend) WriteFile(name string, data []byte) error {
+	return writeFileAtomic(b.root, b.filePath(name), data)
+}
+
+func (b *localBackend) CreateFile(name string, data []byte) error {
+	p := b.filePath(name)
+	err := mkdirAllSync(filepath.Dir(p))
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(p)
+		return err
+	}
+	return syncDir(filepath.Dir(p))
+}
+
+// SwapFile relies on the pack lock to keep other processes from writing between the comparison and the write
+func (b *localBackend) SwapFile(name string, old, data []byte) error {
+	current, err := ioutil.ReadFile(b.filePath(name))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		current = nil
+	}
+	if (old == nil) != (current == nil) || !bytes.Equal(old, current) {
+		return ErrSwapConflict
+	}
+	return b.WriteFile(name, data)
+}
+
+func (b *localBackend) RemoveFile(name string) error {
+	err := os.Remove(b.filePath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (b *localBackend) ListFiles(prefix string) ([]string, error) {
+	dir, base := path.Split(prefix)
+	entries, err := ioutil.ReadDir(b.filePath(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), base) {
+			names = append(names, dir+e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// cleanTemp removes temporary files abandoned by an interrupted run
+func (b *localBackend) cleanTemp() error {
+	return os.RemoveAll(filepath.Join(b.root, tmpDirName))
+}
+
+func statInfo(name, p string) (Info, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return Info{}, err
+	}
+	if info.IsDir() {
+		return Info{}, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+	return Info{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
@@ -0,0 +1,327 @@
+package pack
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	locksDirName      = "locks"
+	exclusiveLockName = "exclusive"
+	sharedLockPrefix  = "shared."
+
+	// lockHeartbeat is how often a held lock's modification time is refreshed
+	lockHeartbeat = time.Minute
+	// staleLockTimeout is how long a lock can go without a heartbeat before it is considered abandoned; locks
+	// held on this host are also considered abandoned as soon as their process has exited
+	staleLockTimeout = 10 * lockHeartbeat
+)
+
+type lockMode int
+
+const (
+	// lockShared allows other readers, but no writers
+	lockShared lockMode = iota
+	// lockExclusive allows no other readers or writers
+	lockExclusive
+)
+
+// packLock is a held lock on a pack
+type packLock struct {
+	b    Backend
+	name string
+	data []byte
+	stop chan struct{}
+	done chan struct{}
+
+	// lost is set once the lock file no longer holds data
+	lost bool
+}
+
+type lockInfo struct {
+	pid     int
+	host    string
+	time    time.Time
+	modTime time.Time
+
+	// data is the lock file's contents
+	data []byte
+}
+
+func (li *lockInfo) String() string {
+	if li.host == "" {
+		return fmt.Sprintf("an unknown process (last heartbeat %s)", li.modTime.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("pid %d on host %s since %s", li.pid, li.host, li.time.Format(time.RFC3339))
+}
+
+// LockedError is returned when a pack is locked by another process
+type LockedError struct {
+	holder *lockInfo
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("pack is locked by %s", e.holder)
+}
+
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+// acquireLock locks the pack; it fails immediately (rather than waiting) if a conflicting lock is held. A shared lock
+// on a write-protected pack is nil.
+func acquireLock(b Backend, mode lockMode) (*packLock, error) {
+	exclusiveName := path.Join(locksDirName, exclusiveLockName)
+
+	if mode == lockExclusive {
+		data, err := createLockFile(b, exclusiveName)
+		if err != nil {
+			return nil, err
+		}
+		// shared locks are created before the holder checks for an exclusive lock, so either they saw ours,
+		// or we see theirs
+		sharedNames, err := b.ListFiles(path.Join(locksDirName, sharedLockPrefix))
+		if err == nil {
+			for _, sharedName := range sharedNames {
+				err = checkLockFile(b, sharedName)
+				if err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			b.RemoveFile(exclusiveName)
+			return nil, err
+		}
+		return startLock(b, exclusiveName, data), nil
+	}
+
+	err := checkLockFile(b, exclusiveName)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newPackID()
+	if err != nil {
+		return nil, err
+	}
+	sharedName := path.Join(locksDirName, fmt.Sprintf("%s%s.%d.%s", sharedLockPrefix, hostname(), os.Getpid(), id[:8]))
+	data, err := createLockFile(b, sharedName)
+	if err != nil {
+		if isWriteProtected(err) {
+			// nothing can change a write-protected pack, so it's read without a lock
+			fmt.Fprintf(os.Stderr, "WARNING: %s is write-protected; reading it without a lock\n", b)
+			return nil, nil
+		}
+		return nil, err
+	}
+	err = checkLockFile(b, exclusiveName)
+	if err != nil {
+		b.RemoveFile(sharedName)
+		return nil, err
+	}
+	return startLock(b, sharedName, data), nil
+}
+
+// createLockFile creates the named lock file, taking over the lock if its current holder has gone away; it
+// returns the lock file's contents
+func createLockFile(b Backend, name string) ([]byte, error) {
+	data := []byte(fmt.Sprintf("pid=%d\nhost=%s\ntime=%s\n", os.Getpid(), hostname(), time.Now().UTC().Format(time.RFC3339)))
+	err := b.CreateFile(name, data)
+	if errors.Is(err, os.ErrExist) {
+		var stale *lockInfo
+		stale, err = staleLock(b, name)
+		if err != nil {
+			return nil, err
+		}
+		if stale == nil {
+			// it was released in the meantime
+			err = b.CreateFile(name, data)
+		} else {
+			// the stale lock is replaced (rather than removed and created again), so that of several processes
+			// taking it over at once, only one succeeds
+			fmt.Fprintf(os.Stderr, "taking over stale lock %s held by %s\n", name, stale)
+			err = b.SwapFile(name, stale.data, data)
+		}
+		if errors.Is(err, os.ErrExist) || errors.Is(err, ErrSwapConflict) {
+			return nil, lockedBy(b, name)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// confirm that the lock is ours, in case the backend's swap isn't atomic and another process replaced it too
+	current, err := b.ReadFile(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if !bytes.Equal(current, data) {
+		return nil, lockedBy(b, name)
+	}
+	return data, nil
+}
+
+// lockedBy returns a LockedError for the named lock, which another process has just taken
+func lockedBy(b Backend, name string) error {
+	li, err := readLockFile(b, name)
+	if err != nil {
+		li = &lockInfo{modTime: time.Now()}
+	}
+	return &LockedError{holder: li}
+}
+
+// checkLockFile returns a LockedError if the named lock is held by a live process; stale locks are removed
+func checkLockFile(b Backend, name string) error {
+	stale, err := staleLock(b, name)
+	if err != nil || stale == nil {
+		return err
+	}
+	// the lock may have been refreshed or taken over since it was read, in which case it's no longer stale
+	current, err := b.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, stale.data) {
+		return checkLockFile(b, name)
+	}
+	fmt.Fprintf(os.Stderr, "removing stale lock %s held by %s\n", name, stale)
+	return b.RemoveFile(name)
+}
+
+// staleLock returns the named lock if it's stale, nil if it doesn't exist, or a LockedError if it's held by a live
+// process
+func staleLock(b Backend, name string) (*lockInfo, error) {
+	li, err := readLockFile(b, name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !isStaleLock(li) {
+		return nil, &LockedError{holder: li}
+	}
+	return li, nil
+}
+
+func readLockFile(b Backend, name string) (*lockInfo, error) {
+	data, err := b.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := b.StatFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// a lock file which can't be parsed (e.g. its holder crashed while writing it) is treated as stale
+	// once its heartbeat expires
+	li := &lockInfo{modTime: info.ModTime, data: data}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "=", 2)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "pid":
+			li.pid, _ = strconv.Atoi(fields[1])
+		case "host":
+			li.host = fields[1]
+		case "time":
+			li.time, _ = time.Parse(time.RFC3339, fields[1])
+		}
+	}
+	return li, nil
+}
+
+// isWriteProtected returns true if err was caused by the pack being write-protected; other errors (such as a
+// permission error, which may hide an active writer) aren't
+func isWriteProtected(err error) bool {
+	return errors.Is(err, syscall.EROFS) || errors.Is(err, ErrWriteProtected)
+}
+
+func isStaleLock(li *lockInfo) bool {
+	if li.host == hostname() && li.pid > 0 && !processAlive(li.pid) {
+		return true
+	}
+	return time.Since(li.modTime) > staleLockTimeout
+}
+
+// startLock starts refreshing the lock's heartbeat (by rewriting it, which updates its modification time) until it
+// is released, or lost
+func startLock(b Backend, name string, data []byte) *packLock {
+	l := &packLock{
+		b:    b,
+		name: name,
+		data: data,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(lockHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-ticker.C:
+				if !l.refresh() {
+					return
+				}
+			}
+		}
+	}()
+	return l
+}
+
+// refresh rewrites the lock file, but only if it's still ours: if it went stale (e.g. while the machine was
+// suspended), another process may have removed it and taken the lock over. It returns false once the lock is lost.
+func (l *packLock) refresh() bool {
+	err := l.b.SwapFile(l.name, l.data, l.data)
+	if errors.Is(err, ErrSwapConflict) {
+		fmt.Fprintf(os.Stderr, "WARNING: lost lock %s; another process may have taken it over\n", l.name)
+		l.lost = true
+		return false
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: failed to refresh lock %s: %s\n", l.name, err)
+	}
+	return true
+}
+
+// Release unlocks the pack; it returns an error (leaving the lock file alone) if the lock was lost while it was held
+func (l *packLock) Release() error {
+	if l == nil {
+		return nil
+	}
+	close(l.stop)
+	<-l.done
+	if !l.lost {
+		data, err := l.b.ReadFile(l.name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		l.lost = !bytes.Equal(data, l.data)
+	}
+	if l.lost {
+		return fmt.Errorf("lost lock %s while it was held; another process may have taken it over", l.name)
+	}
+	return l.b.RemoveFile(l.name)
+}
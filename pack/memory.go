@@ -0,0 +1,175 @@
+package pack
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	data    []byte
+	modTime time.Time
+}
+
+// memoryBackend stores a pack in memory; it's intended for tests
+type memoryBackend struct {
+	mu      sync.Mutex
+	objects map[string]memoryEntry
+	files   map[string]memoryEntry
+}
+
+// NewMemoryBackend returns an empty backend which stores a pack in memory
+func NewMemoryBackend() Backend {
+	return &memoryBackend{
+		objects: map[string]memoryEntry{},
+		files:   map[string]memoryEntry{},
+	}
+}
+
+func (b *memoryBackend) String() string {
+	return "memory"
+}
+
+func (b *memoryBackend) ObjectLocation(name string) string {
+	return "memory:" + name
+}
+
+type memoryObjectWriter struct {
+	bytes.Buffer
+	b *memoryBackend
+}
+
+func (w *memoryObjectWriter) Commit(name string) error {
+	w.b.mu.Lock()
+	defer w.b.mu.Unlock()
+	w.b.objects[name] = memoryEntry{data: append([]byte(nil), w.Bytes()...), modTime: time.Now()}
+	return nil
+}
+
+func (w *memoryObjectWriter) Abort() {
+	w.Reset()
+}
+
+func (b *memoryBackend) CreateObject() (ObjectWriter, error) {
+	return &memoryObjectWriter{b: b}, nil
+}
+
+func (b *memoryBackend) GetObject(name string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.objects[name]
+	if !ok {
+		return nil, notExist(name)
+	}
+	return ioutil.NopCloser(bytes.NewReader(e.data)), nil
+}
+
+func (b *memoryBackend) StatObject(name string) (Info, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.objects[name]
+	if !ok {
+		return Info{}, notExist(name)
+	}
+	return Info{Name: name, Size: int64(len(e.data)), ModTime: e.modTime}, nil
+}
+
+func (b *memoryBackend) ListObjects() ([]Info, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var objects []Info
+	for name, e := range b.objects {
+		objects = append(objects, Info{Name: name, Size: int64(len(e.data)), ModTime: e.modTime})
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	return objects, nil
+}
+
+func (b *memoryBackend) DeleteObject(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.objects[name]; !ok {
+		return notExist(name)
+	}
+	delete(b.objects, name)
+	return nil
+}
+
+func (b *memoryBackend) ReadFile(name string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.files[name]
+	if !ok {
+		return nil, notExist(name)
+	}
+	return append([]byte(nil), e.data...), nil
+}
+
+func (b *memoryBackend) StatFile(name string) (Info, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.files[name]
+	if !ok {
+		return Info{}, notExist(name)
+	}
+	return Info{Name: name, Size: int64(len(e.data)), ModTime: e.modTime}, nil
+}
+
+func (b *memoryBackend) WriteFile(name string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.files[name] = memoryEntry{data: append([]byte(nil), data...), modTime: time.Now()}
+	return nil
+}
+
+func (b *memoryBackend) CreateFile(name string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.files[name]; ok {
+		return &os.PathError{Op: "create", Path: name, Err: os.ErrExist}
+	}
+	b.files[name] = memoryEntry{data: append([]byte(nil), data...), modTime: time.Now()}
+	return nil
+}
+
+func (b *memoryBackend) SwapFile(name string, old, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.files[name]
+	if ok != (old != nil) || !bytes.Equal(e.data, old) {
+		return ErrSwapConflict
+	}
+	b.files[name] = memoryEntry{data: append([]byte(nil), data...), modTime: time.Now()}
+	return nil
+}
+
+func (b *memoryBackend) RemoveFile(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.files, name)
+	return nil
+}
+
+func (b *memoryBackend) ListFiles(prefix string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var names []string
+	for name := range b.files {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func notExist(name string) error {
+	return &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+}
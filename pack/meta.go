@@ -0,0 +1,293 @@
+package pack
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// layoutVersionThreeLevel stored objects under data/xx/yy/zz/<sha1>; packs of this era have no meta file
+	layoutVersionThreeLevel = 1
+	// layoutVersionTwoLevel stores objects under data/xx/yy/<sha1>
+	layoutVersionTwoLevel = 2
+
+	// currentVersion is the pack format version written by this version of acbup
+	currentVersion = layoutVersionTwoLevel
+
+	metaFileName = "meta"
+	hashSha1     = "sha1"
+)
+
+var (
+	errUnversionedPack = fmt.Errorf("pack has no meta file (it was created by an older version of acbup); run with --upgrade to convert it")
+	errCorruptMeta     = fmt.Errorf("corrupt meta file")
+)
+
+// packMeta holds the contents of the meta file stored at the root of every pack
+type packMeta struct {
+	version    int
+	id         string
+	created    time.Time
+	hash       string
+	parityBits int
+
+	// appendOnly packs refuse operations which would overwrite or delete data; damaged objects are repaired by
+	// storing additional copies
+	appendOnly bool
+}
+
+func newPackMeta(parityBits int) (*packMeta, error) {
+	id, err := newPackID()
+	if err != nil {
+		return nil, err
+	}
+	return &packMeta{
+		version:    currentVersion,
+		id:         id,
+		created:    time.Now().UTC(),
+		hash:       hashSha1,
+		parityBits: parityBits,
+	}, nil
+}
+
+func newPackID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func readMeta(b Backend) (*packMeta, error) {
+	data, err := b.ReadFile(metaFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &packMeta{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) < 2 {
+			return nil, errCorruptMeta
+		}
+		key := strings.TrimSpace(fields[0])
+		val := strings.TrimSpace(fields[1])
+
+		switch key {
+		case "version":
+			m.version, err = strconv.Atoi(val)
+		case "id":
+			m.id = val
+		case "created":
+			m.created, err = time.Parse(time.RFC3339, val)
+		case "hash":
+			m.hash = val
+		case "parity":
+			m.parityBits, err = strconv.Atoi(val)
+		case "append_only":
+			m.appendOnly, err = strconv.ParseBool(val)
+		default:
+			// unknown keys are tolerated so that newer minor additions don't lock out older readers;
+			// incompatible changes must bump the version instead.
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad value for %s: %s", errCorruptMeta, key, err)
+		}
+	}
+	if m.version == 0 || m.id == "" {
+		return nil, errCorruptMeta
+	}
+	return m, nil
+}
+
+func writeMeta(b Backend, m *packMeta) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "version=%d\n", m.version)
+	fmt.Fprintf(&buf, "id=%s\n", m.id)
+	fmt.Fprintf(&buf, "created=%s\n", m.created.Format(time.RFC3339))
+	fmt.Fprintf(&buf, "hash=%s\n", m.hash)
+	fmt.Fprintf(&buf, "parity=%d\n", m.parityBits)
+	if m.appendOnly {
+		fmt.Fprintf(&buf, "append_only=1\n")
+	}
+
+	return b.WriteFile(metaFileName, buf.Bytes())
+}
+
+// checkMeta ensures the pack described by m can be handled by this version of acbup
+func checkMeta(m *packMeta, parityBits int) error {
+	if m.version != currentVersion {
+		if m.version < currentVersion {
+			return fmt.Errorf("pack version %d is out of date (current version is %d); run with --upgrade to convert it", m.version, currentVersion)
+		}
+		return fmt.Errorf("unsupported pack version %d (this version of acbup supports up to version %d)", m.version, currentVersion)
+	}
+	if m.hash != hashSha1 {
+		return fmt.Errorf("unsupported pack hash algorithm %q", m.hash)
+	}
+	if m.parityBits != parityBits {
+		return fmt.Errorf("pack was created with par=%d, but par=%d was configured", m.parityBits, parityBits)
+	}
+	return nil
+}
+
+// isEmptyPack returns true if the backend contains neither a meta file nor any refs
+func isEmptyPack(b Backend) bool {
+	return !fileExists(b, metaFileName) && !fileExists(b, refsFileName)
+}
+
+// Init creates a new empty pack in the backend and returns its id; an appendOnly pack refuses to overwrite or
+// delete anything which has been added to it
+func Init(b Backend, parityBits int, appendOnly bool) (string, error) {
+	if parityBits < 0 || parityBits > 1 {
+		return "", errInvalidParityBitsConfig
+	}
+	if !isEmptyPack(b) {
+		return "", fmt.Errorf("%s already contains a pack", b)
+	}
+	lock, err := acquireLock(b, lockExclusive)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Release()
+	if !isEmptyPack(b) {
+		return "", fmt.Errorf("%s already contains a pack", b)
+	}
+
+	m, err := newPackMeta(parityBits)
+	if err != nil {
+		return "", err
+	}
+	m.appendOnly = appendOnly
+	err = writeMeta(b, m)
+	if err != nil {
+		return "", err
+	}
+	return m.id, nil
+}
+
+// Upgrade converts a pack created by an older version of acbup to the current format; since older versions only
+// wrote to local directories, so does Upgrade
+func Upgrade(b Backend, parityBits int) error {
+	lb, ok := b.(*localBackend)
+	if !ok {
+		return fmt.Errorf("%s was not created by an older version of acbup, which only supported local directories", b)
+	}
+	packRoot := lb.root
+	if isEmptyPack(b) {
+		return fmt.Errorf("%s does not contain a pack", packRoot)
+	}
+	lock, err := acquireLock(b, lockExclusive)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	m, err := readMeta(b)
+	if err == nil {
+		if m.version > currentVersion {
+			return fmt.Errorf("unsupported pack version %d (this version of acbup supports up to version %d)", m.version, currentVersion)
+		}
+		if m.version == currentVersion {
+			fmt.Fprintf(os.Stderr, "%s is already at version %d\n", packRoot, currentVersion)
+			return nil
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	} else {
+		m, err = newPackMeta(parityBits)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = convertThreeLevelLayout(packRoot)
+	if err != nil {
+		return err
+	}
+
+	err = seedReflog(b)
+	if err != nil {
+		return err
+	}
+
+	m.version = currentVersion
+	fmt.Fprintf(os.Stderr, "writing %s version %d\n", filepath.Join(packRoot, metaFileName), currentVersion)
+	return writeMeta(b, m)
+}
+
+// convertThreeLevelLayout moves any objects stored under data/xx/yy/zz/ into data/xx/yy/
+func convertThreeLevelLayout(packRoot string) error {
+	dataRoot := filepath.Join(packRoot, "data")
+	var dirs []string
+	err := filepath.Walk(dataRoot,
+		func(walkPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && walkPath == dataRoot {
+					return nil
+				}
+				return err
+			}
+			rel, err := filepath.Rel(dataRoot, walkPath)
+			if err != nil {
+				return err
+			}
+			parts := strings.Split(rel, string(filepath.Separator))
+			if info.IsDir() {
+				if len(parts) == 3 {
+					dirs = append(dirs, walkPath)
+				}
+				return nil
+			}
+			if len(parts) != 4 {
+				return nil
+			}
+			name := parts[3]
+			if len(name) < 40 || parts[0] != name[0:2] || parts[1] != name[2:4] || parts[2] != name[4:6] {
+				return fmt.Errorf("unexpected file %s in three-level data layout", walkPath)
+			}
+			newPath := filepath.Join(dataRoot, parts[0], parts[1], name)
+			fmt.Fprintf(os.Stderr, "moving %s -> %s\n", walkPath, newPath)
+			return os.Rename(walkPath, newPath)
+		})
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		err = os.Remove(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedReflog records the current refs pointer in the reflog of packs which predate it
+func seedReflog(b Backend) error {
+	entries, _, err := readReflog(b)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return nil
+	}
+	refsSha1, err := readRefsPointer(b)
+	if err != nil {
+		return err
+	}
+	return appendReflog(b, reflogEntry{sha1: refsSha1, time: time.Now()})
+}
@@ -0,0 +1,148 @@
+package pack
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Mirror backs up the same files to several packs (each of which gets its own snapshot), reading each file only
+// once. A pack which fails is dropped, and its error kept, so that the other packs can carry on.
+type Mirror struct {
+	packs    []*packImp
+	errs     []error
+	volatile []VolatileFile
+}
+
+// NewMirror returns a Mirror which backs up to packs, which must have been opened by New for writing
+func NewMirror(packs []Pack) *Mirror {
+	m := &Mirror{errs: make([]error, len(packs))}
+	for _, p := range packs {
+		m.packs = append(m.packs, p.(*packImp))
+	}
+	return m
+}
+
+// Err returns the error which the i'th pack failed with, or nil if it hasn't failed
+func (m *Mirror) Err(i int) error {
+	return m.errs[i]
+}
+
+// VolatileFiles returns the files which changed while they were being stored
+func (m *Mirror) VolatileFiles() []VolatileFile {
+	return m.volatile
+}
+
+func (m *Mirror) fail(i int, err error) {
+	fmt.Fprintf(os.Stderr, "ERROR: backup to %s failed: %s; continuing with the other destinations\n", m.packs[i].backend, err)
+	m.errs[i] = err
+}
+
+// live returns the indices of the packs which haven't failed
+func (m *Mirror) live() []int {
+	var live []int
+	for i := range m.packs {
+		if m.errs[i] == nil {
+			live = append(live, i)
+		}
+	}
+	return live
+}
+
+// AddFile adds a file to every pack which hasn't failed; it only returns an error if the file couldn't be read, if
+// ctx is done, or once every pack has failed
+func (m *Mirror) AddFile(ctx context.Context, path, alias string) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	live := m.live()
+	if len(live) == 0 {
+		return ErrAllPacksFailed
+	}
+
+	pathAndAlias := describePath(path, alias)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	h := &fileHasher{path: path}
+	var store []int
+	for _, i := range live {
+		ok, err := m.packs[i].addUnchanged(h, alias, pathAndAlias, info)
+		if err != nil {
+			m.fail(i, err)
+			continue
+		}
+		if !ok {
+			store = append(store, i)
+		}
+	}
+	if len(store) == 0 {
+		return nil
+	}
+
+	packs := make([]*packImp, len(store))
+	for j, i := range store {
+		packs[j] = m.packs[i]
+	}
+	volatile, errs, err := storeFileInPacks(packs, path, alias, pathAndAlias, info)
+	if volatile != nil {
+		m.volatile = append(m.volatile, *volatile)
+	}
+	if err != nil {
+		return err
+	}
+	for j, i := range store {
+		if errs[j] != nil {
+			m.fail(i, errs[j])
+		}
+	}
+	return nil
+}
+
+// AddDir adds a dir to every pack which hasn't failed; cancelling ctx stops it once the file currently being added
+// is done
+func (m *Mirror) AddDir(ctx context.Context, path, alias string) error {
+	if alias != path {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("path must start with /")
+		}
+		if !strings.HasPrefix(alias, "/") {
+			return fmt.Errorf("alias must start with /")
+		}
+	}
+	n := len(path)
+	return filepath.Walk(path,
+		func(walkPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			err = m.AddFile(ctx, walkPath, alias+walkPath[n:])
+			if err != nil {
+				return err
+			}
+			for _, i := range m.live() {
+				err := m.packs[i].maybeCheckpoint()
+				if err != nil {
+					m.fail(i, err)
+				}
+			}
+			return nil
+		})
+}
+
+// Checkpoint writes a partial snapshot to every pack which hasn't failed
+func (m *Mirror) Checkpoint() {
+	for _, i := range m.live() {
+		err := m.packs[i].Checkpoint()
+		if err != nil {
+			m.fail(i, err)
+		}
+	}
+}
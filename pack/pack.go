@@ -3,6 +3,7 @@ package pack
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"errors"
@@ -10,81 +11,284 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/alexcb/acbup/util/fileutil"
 	"github.com/alexcb/acbup/util/promptutil"
 )
 
 // Pack defines the pack interface
 type Pack interface {
-	AddDir(string, string) error
-	AddFile(string, string) error
+	AddDir(context.Context, string, string) error
+	AddFile(context.Context, string, string) error
 	Close() error
+	Abort() error
+	Checkpoint() error
 	List() ([]string, error)
-	Verify() bool
-	Recover() (int, int, int, error)
-	Restore(string, string) error
+	Verify(context.Context) (bool, error)
+	Recover(context.Context) (int, int, int, error)
+	Restore(context.Context, string, string) error
+	RestoreTree(context.Context, RestoreOptions) (RestoreStats, error)
+	Open(string) (io.ReadCloser, error)
+	OpenSnapshot(string, string) (io.ReadCloser, error)
+	OpenObject(string) (io.ReadCloser, error)
+	VolatileFiles() []VolatileFile
 }
 
 type packImp struct {
-	root        string
+	backend     Backend
 	refs        []*refEntry
 	refIndex    map[string]*refEntry
 	readOnly    bool
 	interactive bool
 	parityBits  int
+	meta        *packMeta
+
+	// head is the sha1 of the refs which were loaded (or last written)
+	head string
+
+	// headPartial is true when head was written by a checkpoint (or an interrupted backup) rather than a
+	// completed backup
+	headPartial bool
+
+	// resumed holds the paths which were recorded by interrupted runs since the last complete snapshot (it's only set
+	// when the pack is opened with a partial head); those files aren't re-hashed if they look unchanged
+	resumed map[string]bool
+
+	// pointerErr is set when the refs pointer was damaged and refs were instead loaded from the reflog
+	pointerErr error
+
+	// pointer holds the contents of the refs pointer as last read or written (nil if it didn't exist); it's
+	// only replaced if it still holds them
+	pointer []byte
+
+	lock *packLock
+
+	checkpointFiles      int
+	checkpointInterval   time.Duration
+	filesSinceCheckpoint int
+	lastCheckpoint       time.Time
+
+	onChange      ChangePolicy
+	changeRetries int
+	volatile      []VolatileFile
+
+	repairFrom []Backend
+}
+
+// Options control how a pack is opened
+type Options struct {
+	ReadOnly    bool
+	Interactive bool
+	ParityBits  int
+
+	// PackID, when set, must match the id recorded in the pack's meta file; this guards against
+	// writing to the wrong disk (or to an empty mount point when the disk isn't mounted)
+	PackID string
+
+	// AppendOnly, when set, requires the pack to have been created append-only, so that a pack which is relied on
+	// to keep its history isn't silently replaced by one which doesn't
+	AppendOnly bool
+
+	// CheckpointFiles and CheckpointInterval control how often AddDir writes a partial snapshot, so that an
+	// interrupted backup keeps its progress; zero disables the corresponding trigger
+	CheckpointFiles    int
+	CheckpointInterval time.Duration
+
+	// OnChange decides what happens to files which change while they are being stored, and ChangeRetries is how
+	// many times ChangeRetry copies such a file again
+	OnChange      ChangePolicy
+	ChangeRetries int
+
+	// RepairFrom lists other packs holding the same content (e.g. mirrors); Recover fetches objects which can't be
+	// recovered from the pack's own copies from them, and restores read from them when no copy in the pack is intact
+	RepairFrom []Backend
 }
 
-var errInvalidParityBitsConfig = fmt.Errorf("invalid parity bits config")
+var (
+	errInvalidParityBitsConfig = fmt.Errorf("invalid parity bits config")
+	errNoPack                  = fmt.Errorf("no pack found; run with --init to create one")
+)
 
-// New returns a new Pack
-func New(packRoot string, readOnly, interactive bool, parityBits int) (Pack, error) {
+// New opens the pack stored in the backend
+func New(b Backend, opts Options) (Pack, error) {
 	var refs []*refEntry
 	refIndex := map[string]*refEntry{}
 
+	parityBits := opts.ParityBits
+	readOnly := opts.ReadOnly
 	if parityBits < 0 || parityBits > 1 {
 		fmt.Printf("got %d\n", parityBits)
 		return nil, errInvalidParityBitsConfig
 	}
 
-	refsPath := filepath.Join(packRoot, "refs")
-	if fileutil.FileExists(refsPath) {
-		refsSha1, err := readFileContainingSha1Reference(refsPath)
-		if err != nil {
-			return nil, err
+	meta, err := readMeta(b)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			if isEmptyPack(b) {
+				return nil, fmt.Errorf("%s: %w", b, errNoPack)
+			}
+			return nil, errUnversionedPack
 		}
+		return nil, err
+	}
+	err = checkMeta(meta, parityBits)
+	if err != nil {
+		return nil, err
+	}
+	if opts.PackID != "" && opts.PackID != meta.id {
+		return nil, fmt.Errorf("%s contains pack %s, but pack_id=%s was configured", b, meta.id, opts.PackID)
+	}
+	if opts.AppendOnly && !meta.appendOnly {
+		return nil, fmt.Errorf("%s contains pack %s, which is not append-only, but append_only=true was configured", b, meta.id)
+	}
+	if meta.appendOnly {
+		b = newAppendOnlyBackend(b)
+	}
 
-		path, err := getShaPath(packRoot, refsSha1, false)
+	lockMode := lockExclusive
+	if readOnly {
+		lockMode = lockShared
+	}
+	lock, err := acquireLock(b, lockMode)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := b.(tempCleaner); ok && !readOnly {
+		// with the exclusive lock held, any temporary files were abandoned by an interrupted run
+		err = tc.cleanTemp()
 		if err != nil {
+			lock.Release()
 			return nil, err
 		}
+	}
 
-		refs, err = readRefs(path, refsSha1, readOnly)
-		if err != nil {
+	pointer, err := b.ReadFile(refsFileName)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			lock.Release()
 			return nil, err
 		}
+		pointer = nil
+	}
+	head, refs, pointerErr, err := loadRefs(b, readOnly)
+	if err != nil {
+		lock.Release()
+		return nil, err
+	}
+	if refs != nil {
 		refIndex = buildRefIndex(refs)
-
+	}
+	headPartial, err := isPartialHead(b, head)
+	if err != nil {
+		lock.Release()
+		return nil, err
+	}
+	var resumed map[string]bool
+	if headPartial {
+		resumed, err = resumedPaths(b, head, refs)
+		if err != nil {
+			lock.Release()
+			return nil, err
+		}
 	}
 
 	p := &packImp{
-		root:        packRoot,
+		backend:     b,
 		refIndex:    refIndex,
 		refs:        refs,
 		readOnly:    readOnly,
-		interactive: interactive,
+		interactive: opts.Interactive,
 		parityBits:  parityBits,
+		meta:        meta,
+		head:        head,
+		pointerErr:  pointerErr,
+		pointer:     pointer,
+		lock:        lock,
+
+		headPartial:        headPartial,
+		resumed:            resumed,
+		checkpointFiles:    opts.CheckpointFiles,
+		checkpointInterval: opts.CheckpointInterval,
+		lastCheckpoint:     time.Now(),
+
+		onChange:      opts.OnChange,
+		changeRetries: opts.ChangeRetries,
+
+		repairFrom: opts.RepairFrom,
 	}
 
 	return p, nil
 }
 
-// Close closes the pack
+// loadRefs reads the refs that the refs pointer references; if the pointer (or the refs it references) is damaged,
+// the newest valid reflog entry is used instead and the pointer error is returned as pointerErr.
+func loadRefs(b Backend, readOnly bool) (head string, refs []*refEntry, pointerErr error, err error) {
+	if fileExists(b, refsFileName) {
+		head, refs, pointerErr = loadRefsFromPointer(b, readOnly)
+		if pointerErr == nil {
+			return head, refs, nil, nil
+		}
+	} else {
+		pointerErr = fmt.Errorf("%s/%s is missing", b, refsFileName)
+	}
+
+	entries, _, err := readReflog(b)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if len(entries) == 0 {
+		if fileExists(b, refsFileName) {
+			return "", nil, nil, pointerErr
+		}
+		// a brand new pack
+		return "", nil, nil, nil
+	}
+
+	fmt.Fprintf(os.Stderr, "WARNING: failed to read refs: %s; falling back to reflog\n", pointerErr)
+	head, refs, err = loadRefsFromReflog(b, readOnly)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("%s; %s", pointerErr, err)
+	}
+	return head, refs, pointerErr, nil
+}
+
+func loadRefsFromPointer(b Backend, readOnly bool) (string, []*refEntry, error) {
+	refsSha1, err := readRefsPointer(b)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read %s/%s: %w", b, refsFileName, err)
+	}
+
+	refs, err := readRefs(b, refsSha1, readOnly)
+	if err != nil {
+		return "", nil, err
+	}
+	return refsSha1, refs, nil
+}
+
+// Close writes the refs (unless the pack is read-only) and unlocks the pack
 func (p *packImp) Close() error {
-	return p.writeRefs(p.refs)
+	var err error
+	if !p.readOnly {
+		err = p.writeRefs(p.refs, false)
+	}
+	lockErr := p.lock.Release()
+	p.lock = nil
+	if err != nil {
+		return err
+	}
+	return lockErr
+}
+
+// Abort unlocks the pack without writing refs; anything added since the pack was opened is discarded
+func (p *packImp) Abort() error {
+	err := p.lock.Release()
+	p.lock = nil
+	return err
 }
 
 func splitShaToPath(s string) []string {
@@ -100,7 +304,7 @@ func splitShaToPath(s string) []string {
 
 func getShaPath(packRoot, sha1 string, mkDir bool) (string, error) {
 	if len(sha1) != 40 {
-		panic("invalid sha")
+		return "", errInvalidSha1
 	}
 
 	dataPathParts := []string{packRoot, "data"}
@@ -109,7 +313,7 @@ func getShaPath(packRoot, sha1 string, mkDir bool) (string, error) {
 
 	if mkDir {
 		dirPath := filepath.Dir(path)
-		err := os.MkdirAll(dirPath, 0700)
+		err := mkdirAllSync(dirPath)
 		if err != nil {
 			return "", err
 		}
@@ -145,117 +349,109 @@ func getSha1(path string) (string, error) {
 	return hash, nil
 }
 
-func copyFile(src, dst, expectedHash string, parityBits int) error {
-	const bufferSize = 1024 * 1024 * 16
-	srcFile, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer srcFile.Close()
-
-	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return err
-	}
-	defer dstFile.Close()
-
-	h := sha1.New()
-	buffer := make([]byte, bufferSize)
-
-	for {
-		bytesread, err := srcFile.Read(buffer)
-		if err != nil {
-			if err != io.EOF {
-				return err
-			}
-			break
-		}
-		io.WriteString(dstFile, string(buffer[:bytesread]))
-		io.WriteString(h, string(buffer[:bytesread]))
-	}
-	hash := fmt.Sprintf("%x", h.Sum(nil))
-	if hash != expectedHash {
-		panic("hash missmatch, perhaps someone else wrote to the file while the copy was happening?")
-	}
-
-	// TODO create parity bits instead
-	if parityBits == 1 {
-		pathCopy := dst + ".bkup"
-		fmt.Fprintf(os.Stderr, "creating backup %s -> %s\n", dst, pathCopy)
-		err = fileutil.CopyFileContents(dst, pathCopy)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
 var errInvalidSha1 = fmt.Errorf("invalid sha1")
 
-func readFileContainingSha1Reference(path string) (string, error) {
-	data, err := ioutil.ReadFile(path)
+// readRefsPointer returns the sha1 of the refs which the refs pointer references
+func readRefsPointer(b Backend) (string, error) {
+	data, err := b.ReadFile(refsFileName)
 	if err != nil {
 		return "", err
 	}
 	s := string(data)
-	if len(s) != 40 {
+	if !isSha1(s) {
 		return "", errInvalidSha1
 	}
 	return s, nil
 }
 
-func restoreFromBkup(path, expectedSha1 string) error {
-	pathBkup := path + ".bkup"
-	actualSha1, err := getSha1(pathBkup)
+// restoreFromBkup replaces a corrupt object with its bkup; in an append-only pack a repair copy is added instead
+func restoreFromBkup(b Backend, expectedSha1 string) error {
+	if isAppendOnly(b) {
+		return addRepairCopy(b, expectedSha1)
+	}
+	bkupName := expectedSha1 + bkupSuffix
+	actualSha1, err := hashObject(b, bkupName)
 	if err != nil {
 		return err
 	}
 	if actualSha1 != expectedSha1 {
-		return fmt.Errorf("bkup sha1 expected %s vs actual %s", expectedSha1, actualSha1)
+		return &CorruptObjectError{Path: b.ObjectLocation(bkupName), Expected: expectedSha1, Actual: actualSha1}
 	}
-	err = fileutil.CopyFileContents(pathBkup, path)
+	err = copyObject(b, bkupName, expectedSha1)
 	if err != nil {
 		return err
 	}
-	restoredSha1, err := getSha1(path)
+	restoredSha1, err := hashObject(b, expectedSha1)
 	if err != nil {
 		return err
 	}
 	if restoredSha1 != expectedSha1 {
-		return fmt.Errorf("restore failed to produce matching sha1 expected %s vs actual %s", expectedSha1, restoredSha1)
+		return &CorruptObjectError{Path: b.ObjectLocation(expectedSha1), Expected: expectedSha1, Actual: restoredSha1}
 	}
-	fmt.Fprintf(os.Stderr, "restored %s from %s\n", path, pathBkup)
+	fmt.Fprintf(os.Stderr, "restored %s from %s\n", b.ObjectLocation(expectedSha1), b.ObjectLocation(bkupName))
 	return nil
 }
 
-func rebuildBkup(path, expectedSha1 string) error {
-	pathBkup := path + ".bkup"
-	actualSha1, err := getSha1(path)
+// rebuildBkup replaces a corrupt (or missing) bkup with a copy of its object; in an append-only pack a repair copy
+// is added instead
+func rebuildBkup(b Backend, expectedSha1 string) error {
+	if isAppendOnly(b) {
+		return addRepairCopy(b, expectedSha1)
+	}
+	bkupName := expectedSha1 + bkupSuffix
+	actualSha1, err := hashObject(b, expectedSha1)
 	if err != nil {
 		return err
 	}
 	if actualSha1 != expectedSha1 {
-		return fmt.Errorf("original sha1 expected %s vs actual %s", expectedSha1, actualSha1)
+		return &CorruptObjectError{Path: b.ObjectLocation(expectedSha1), Expected: expectedSha1, Actual: actualSha1}
 	}
-	err = fileutil.CopyFileContents(path, pathBkup)
+	err = copyObject(b, expectedSha1, bkupName)
 	if err != nil {
 		return err
 	}
-	restoredSha1, err := getSha1(pathBkup)
+	restoredSha1, err := hashObject(b, bkupName)
 	if err != nil {
 		return err
 	}
 	if restoredSha1 != expectedSha1 {
-		return fmt.Errorf("restore failed to produce matching sha1 expected %s vs actual %s", expectedSha1, restoredSha1)
+		return &CorruptObjectError{Path: b.ObjectLocation(bkupName), Expected: expectedSha1, Actual: restoredSha1}
 	}
-	fmt.Fprintf(os.Stderr, "rebuilt %s from %s\n", pathBkup, path)
+	fmt.Fprintf(os.Stderr, "rebuilt %s from %s\n", b.ObjectLocation(bkupName), b.ObjectLocation(expectedSha1))
 	return nil
 }
 
 type refEntry struct {
 	path string
 	sha1 string
+
+	// size and modTime (in unix nanoseconds) describe the file when it was backed up; they are -1 for entries
+	// which predate their recording
+	size    int64
+	modTime int64
+
+	// mode holds the unix file type and permission bits (as in a tar header), or 0 if they weren't recorded; the
+	// object of a symlink holds its target
+	mode int64
+}
+
+// the file types which refs record
+const (
+	modeTypeMask = 0170000
+	modeRegular  = 0100000
+	modeSymlink  = 0120000
+)
+
+func (ref *refEntry) isSymlink() bool {
+	return ref.mode&modeTypeMask == modeSymlink
+}
+
+// perm returns the recorded permissions of a file, or 0644 if they weren't recorded
+func (ref *refEntry) perm() os.FileMode {
+	if ref.mode == 0 {
+		return 0644
+	}
+	return os.FileMode(ref.mode & 0777)
 }
 
 func buildRefIndex(refs []*refEntry) map[string]*refEntry {
@@ -266,23 +462,40 @@ func buildRefIndex(refs []*refEntry) map[string]*refEntry {
 	return m
 }
 
-func readRefs(path, expectedSha1 string, readOnly bool) ([]*refEntry, error) {
-	refsSha1, err := getSha1(path)
+func readRefs(b Backend, expectedSha1 string, readOnly bool) ([]*refEntry, error) {
+	path := b.ObjectLocation(expectedSha1)
+	refsSha1, err := hashObject(b, expectedSha1)
 	if err != nil {
 		return nil, err
 	}
 
+	name := expectedSha1
 	if refsSha1 != expectedSha1 {
-		if readOnly {
-			return nil, fmt.Errorf("detected corruption in %s while reading refs: expected sha1 %s but got %s", path, expectedSha1, refsSha1)
-		}
-		err = restoreFromBkup(path, expectedSha1)
-		if err != nil {
-			return nil, fmt.Errorf("detected corruption in %s while reading refs: expected sha1 %s but got %s; attempted recovery failed: %s", path, expectedSha1, refsSha1, err)
+		reason := fmt.Sprintf("expected sha1 %s but got %s", expectedSha1, refsSha1)
+		switch {
+		case isAppendOnly(b):
+			// the corrupt object can't be replaced, but any intact copy can be read instead
+			name, err = intactCopy(b, expectedSha1)
+			if err != nil {
+				return nil, &RefsCorruptError{Path: path, Reason: fmt.Sprintf("%s; no intact copy found: %s", reason, err)}
+			}
+		case readOnly:
+			return nil, &RefsCorruptError{Path: path, Reason: reason}
+		default:
+			err = restoreFromBkup(b, expectedSha1)
+			if err != nil {
+				return nil, &RefsCorruptError{Path: path, Reason: fmt.Sprintf("%s; attempted recovery failed: %s", reason, err)}
+			}
 		}
 	}
 
-	file, err := os.Open(path)
+	return readRefsObject(b, name)
+}
+
+// readRefsObject parses the named object (a copy of some refs) as refs
+func readRefsObject(b Backend, name string) ([]*refEntry, error) {
+	path := b.ObjectLocation(name)
+	file, err := b.GetObject(name)
 	if err != nil {
 		return nil, err
 	}
@@ -291,43 +504,113 @@ func readRefs(path, expectedSha1 string, readOnly bool) ([]*refEntry, error) {
 	refs := []*refEntry{}
 
 	scanner := bufio.NewScanner(file)
+	lineNum := 0
 	for scanner.Scan() {
+		lineNum++
 		line := scanner.Text()
 		fields := strings.Fields(line)
-		if len(fields) < 2 {
-			panic("corrupt meta file")
+		if len(fields) < 2 || !isSha1(fields[1]) {
+			return nil, &RefsCorruptError{Path: path, Reason: fmt.Sprintf("line %d is malformed", lineNum)}
 		}
 		encodedPath := fields[0]
 		dataRef := fields[1]
 
-		path, err := decodePath(encodedPath)
+		aliasPath, err := decodePath(encodedPath)
 		if err != nil {
-			return nil, err
+			return nil, &RefsCorruptError{Path: path, Reason: fmt.Sprintf("line %d: %s", lineNum, err)}
+		}
+		if !isCleanPath(aliasPath) {
+			// restores join the path to their target dir, so it mustn't be able to lead outside of it
+			return nil, &RefsCorruptError{Path: path, Reason: fmt.Sprintf("line %d: path %q isn't clean", lineNum, aliasPath)}
+		}
+		size, modTime, mode, err := parseRefStat(fields[2:])
+		if err != nil {
+			return nil, &RefsCorruptError{Path: path, Reason: fmt.Sprintf("line %d: %s", lineNum, err)}
 		}
 		refs = append(refs, &refEntry{
-			path: path,
-			sha1: dataRef,
+			path:    aliasPath,
+			sha1:    dataRef,
+			size:    size,
+			modTime: modTime,
+			mode:    mode,
 		})
 	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
 	return refs, nil
 }
 
-func (p *packImp) writeRefs(refs []*refEntry) error {
+// parseRefStat parses the optional size, modification time, and (octal) mode fields of a refs line
+func parseRefStat(fields []string) (size, modTime, mode int64, err error) {
+	if len(fields) < 2 {
+		return -1, -1, 0, nil
+	}
+	size, err = strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	modTime, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if len(fields) > 2 {
+		mode, err = strconv.ParseInt(fields[2], 8, 64)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	return size, modTime, mode, nil
+}
+
+func (p *packImp) writeRefs(refs []*refEntry, partial bool) error {
+	hash, err := p.storeRefs(refs)
+	if err != nil {
+		return err
+	}
+
+	if hash != p.head || partial != p.headPartial {
+		err = appendReflog(p.backend, reflogEntry{sha1: hash, time: time.Now(), partial: partial})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = p.writeRefsPointer(hash)
+	if err != nil {
+		return err
+	}
+	p.head = hash
+	p.headPartial = partial
+	p.pointerErr = nil
+	return nil
+}
+
+// storeRefs stores refs as an object (without recording them in the reflog), and returns its sha1
+func (p *packImp) storeRefs(refs []*refEntry) (string, error) {
 	var buf bytes.Buffer
 	w := bufio.NewWriter(&buf)
 
 	for _, ref := range refs {
 		encPath := encodePath(ref.path)
-		data := fmt.Sprintf("%s %s\n", encPath, ref.sha1)
+		var data string
+		switch {
+		case ref.size < 0:
+			data = fmt.Sprintf("%s %s\n", encPath, ref.sha1)
+		case ref.mode == 0:
+			data = fmt.Sprintf("%s %s %d %d\n", encPath, ref.sha1, ref.size, ref.modTime)
+		default:
+			data = fmt.Sprintf("%s %s %d %d %o\n", encPath, ref.sha1, ref.size, ref.modTime, ref.mode)
+		}
 		_, err := io.WriteString(w, data)
 		if err != nil {
-			return err
+			return "", err
 		}
 	}
 
 	err := w.Flush()
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	data := buf.String()
@@ -337,111 +620,215 @@ func (p *packImp) writeRefs(refs []*refEntry) error {
 	h.Write([]byte(data))
 	hash := fmt.Sprintf("%x", h.Sum(nil))
 
-	dataPath, err := getShaPath(p.root, hash, true)
+	fmt.Fprintf(os.Stderr, "writing to %s\n", p.backend.ObjectLocation(hash))
+	err = putObject(p.backend, hash, []byte(data))
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	fmt.Fprintf(os.Stderr, "writing to %s\n", dataPath)
-	sha1File, err := os.OpenFile(dataPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return err
+	// TODO create parity bits instead
+	if p.parityBits == 1 {
+		err = p.createBkup(hash)
+		if err != nil {
+			return "", err
+		}
 	}
+	return hash, nil
+}
 
-	_, err = io.WriteString(sha1File, data)
+// writeRefsPointer points the refs pointer at hash, provided nobody else has changed it since it was read
+func (p *packImp) writeRefsPointer(hash string) error {
+	fmt.Fprintf(os.Stderr, "writing to %s/%s\n", p.backend, refsFileName)
+	err := p.backend.SwapFile(refsFileName, p.pointer, []byte(hash))
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to update %s/%s: %w", p.backend, refsFileName, err)
 	}
+	p.pointer = []byte(hash)
+	return nil
+}
 
-	err = sha1File.Close()
+// createBkup stores the bkup copy of an object
+func (p *packImp) createBkup(sha1 string) error {
+	bkupName := sha1 + bkupSuffix
+	fmt.Fprintf(os.Stderr, "creating backup %s -> %s\n", p.backend.ObjectLocation(sha1), p.backend.ObjectLocation(bkupName))
+	return copyObject(p.backend, sha1, bkupName)
+}
+
+// AddFile adds a file to the pack; it returns ctx's error without adding the file once ctx is done
+func (p *packImp) AddFile(ctx context.Context, path, alias string) error {
+	err := ctx.Err()
 	if err != nil {
 		return err
 	}
 
-	// TODO create parity bits instead
-	if p.parityBits == 1 {
-		pathCopy := dataPath + ".bkup"
-		fmt.Fprintf(os.Stderr, "creating backup %s -> %s\n", dataPath, pathCopy)
-		err = fileutil.CopyFileContents(dataPath, pathCopy)
-		if err != nil {
-			return err
-		}
-	}
-
-	refsPath := filepath.Join(p.root, "refs")
-	fmt.Fprintf(os.Stderr, "writing to %s\n", refsPath)
-	file, err := os.OpenFile(refsPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	pathAndAlias := describePath(path, alias)
+	info, err := os.Stat(path)
 	if err != nil {
 		return err
 	}
-	_, err = io.WriteString(file, hash)
-	if err != nil {
+	ok, err := p.addUnchanged(&fileHasher{path: path}, alias, pathAndAlias, info)
+	if err != nil || ok {
 		return err
 	}
+	return p.storeFile(path, alias, pathAndAlias, info)
+}
 
-	return file.Close()
+func describePath(path, alias string) string {
+	if path == alias {
+		return path
+	}
+	return fmt.Sprintf("%s (%s)", path, alias)
 }
 
-// AddFile adds a file to the pack
-func (p *packImp) AddFile(path, alias string) error {
-	inputHash, err := getSha1(path)
-	if err != nil {
-		return err
+// fileHasher hashes a file the first time its hash is needed, so that a file which is checked against several packs
+// is only read once
+type fileHasher struct {
+	path string
+	hash string
+	err  error
+	done bool
+}
+
+func (h *fileHasher) sum() (string, error) {
+	if !h.done {
+		h.hash, h.err = getSha1(h.path)
+		h.done = true
 	}
+	return h.hash, h.err
+}
 
-	var pathAndAlias string
-	if path == alias {
-		pathAndAlias = path
-	} else {
-		pathAndAlias = fmt.Sprintf("%s (%s)", path, alias)
+// addUnchanged records a file which looks unchanged since it was recorded (and whose stored copy is intact) without
+// storing it again; it returns false if the file needs to be stored
+func (p *packImp) addUnchanged(h *fileHasher, alias, pathAndAlias string, info os.FileInfo) (bool, error) {
+	size := info.Size()
+	modTime := info.ModTime().UnixNano()
+
+	ref, ok := p.refIndex[alias]
+	if !ok || ref.size != size || ref.modTime != modTime {
+		return false, nil
 	}
+	exists, err := objectExists(p.backend, ref.sha1)
+	if err != nil || !exists {
+		return false, err
+	}
+	if p.resumed[alias] {
+		fmt.Fprintf(os.Stderr, "%q -> %q; %s already backedup by interrupted run\n", pathAndAlias, ref.sha1, p.backend.ObjectLocation(ref.sha1))
+		return true, nil
+	}
+	inputHash, err := h.sum()
+	if err != nil || inputHash != ref.sha1 {
+		return false, err
+	}
+	ok, err = p.verifyStored(pathAndAlias, inputHash)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, p.addMeta(alias, inputHash, size, modTime)
+}
 
+// commitStaged stores a staged copy of a file under hash (unless an intact copy is already stored), and records it
+func (p *packImp) commitStaged(obj ObjectWriter, hash, alias, pathAndAlias string, size, modTime int64) error {
 	if ref, ok := p.refIndex[alias]; ok {
-		if ref.sha1 != inputHash {
-			fmt.Fprintf(os.Stderr, "ERROR: local copy of %s has been changed since backup; curent hash %s vs backed up %s\n", pathAndAlias, inputHash, ref.sha1)
+		if ref.sha1 != hash {
+			fmt.Fprintf(os.Stderr, "ERROR: local copy of %s has been changed since backup; curent hash %s vs backed up %s\n", pathAndAlias, hash, ref.sha1)
 			if !p.interactive {
+				obj.Abort()
 				return fmt.Errorf("unable to save/skip changed file in non-interactive mode")
 			}
 			choice, err := promptutil.Prompt("Save the new version of %s? [y/N] ", []string{"y", "n"}, 1, true)
 			if err != nil {
+				obj.Abort()
 				return err
 			}
 			if choice == "n" {
+				obj.Abort()
 				return nil
 			}
 		}
 	}
 
-	dataPath, err := getShaPath(p.root, inputHash, true)
+	dataPath := p.backend.ObjectLocation(hash)
+	exists, err := objectExists(p.backend, hash)
 	if err != nil {
+		obj.Abort()
 		return err
 	}
 
-	currentBackupSha1, err := getSha1(dataPath)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			fmt.Fprintf(os.Stderr, "%q -> %q; %s backing up\n", pathAndAlias, inputHash, dataPath)
-			err = copyFile(path, dataPath, inputHash, p.parityBits)
-			if err != nil {
-				return err
-			}
-			return p.addMeta(alias, inputHash)
+	if exists {
+		ok, err := p.verifyStored(pathAndAlias, hash)
+		if err != nil {
+			obj.Abort()
+			return err
+		}
+		if ok {
+			obj.Abort()
+			return p.addMeta(alias, hash, size, modTime)
+		}
+		// the backed up copy must be corrupt, if not then it would have been stored under a different path
+		fmt.Fprintf(os.Stderr, "ERROR WARNING CORRUPT DATA FOUND!!!! re-backing up data %q -> %q; %s\n", pathAndAlias, hash, dataPath)
+	} else {
+		fmt.Fprintf(os.Stderr, "%q -> %q; %s backing up\n", pathAndAlias, hash, dataPath)
+	}
+
+	name := hash
+	if exists && isAppendOnly(p.backend) {
+		// the corrupt copies can't be replaced, so the data is stored as a new copy alongside them
+		name, err = nextCopyName(p.backend, hash)
+		if err != nil {
+			obj.Abort()
+			return err
 		}
+	}
+	err = obj.Commit(name)
+	if err != nil {
 		return err
 	}
-	if inputHash != currentBackupSha1 {
-		// the backed up copy must be corrupt, if not then it would have been stored under a different path
-		fmt.Fprintf(os.Stderr, "ERROR WARNING CORRUPT DATA FOUND!!!! re-backing up data %q -> %q; %s\n", pathAndAlias, inputHash, dataPath)
-		return copyFile(path, dataPath, inputHash, p.parityBits)
+
+	// TODO create parity bits instead
+	if p.parityBits == 1 {
+		if name == hash {
+			err = p.createBkup(hash)
+		} else {
+			err = addRepairCopy(p.backend, hash)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return p.addMeta(alias, hash, size, modTime)
+}
+
+// verifyStored checks that the stored object is intact, and rebuilds its bkup if one is missing; it returns false
+// if the object is corrupt
+func (p *packImp) verifyStored(pathAndAlias, hash string) (bool, error) {
+	name, err := intactCopy(p.backend, hash)
+	if err != nil {
+		var corruptErr *CorruptObjectError
+		if errors.As(err, &corruptErr) {
+			return false, nil
+		}
+		return false, err
 	}
+	fmt.Fprintf(os.Stderr, "%q -> %q; %s already backedup (and verified)\n", pathAndAlias, hash, p.backend.ObjectLocation(name))
 
-	// TODO why is there another call to addMeta? perhaps for a last-seen timestamp?
-	fmt.Fprintf(os.Stderr, "%q -> %q; %s already backedup (and verified)\n", pathAndAlias, inputHash, dataPath)
-	return p.addMeta(alias, inputHash)
+	// a previous run may have been interrupted after storing the data but before creating the bkup
+	if p.parityBits == 1 {
+		exists, err := objectExists(p.backend, hash+bkupSuffix)
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			err = rebuildBkup(p.backend, hash)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	return true, nil
 }
 
-// AddDir adds a dir to the pack
-func (p *packImp) AddDir(path, alias string) error {
+// AddDir adds a dir to the pack; cancelling ctx stops it once the file currently being added is done
+func (p *packImp) AddDir(ctx context.Context, path, alias string) error {
 	if alias != path {
 		if !strings.HasPrefix(path, "/") {
 			return fmt.Errorf("path must start with /")
@@ -460,11 +847,36 @@ func (p *packImp) AddDir(path, alias string) error {
 				return nil
 			}
 			walkAlias := alias + walkPath[n:]
-			return p.AddFile(walkPath, walkAlias)
+			err = p.AddFile(ctx, walkPath, walkAlias)
+			if err != nil {
+				return err
+			}
+			return p.maybeCheckpoint()
 		})
 	return err
 }
 
+// snapshotRefs returns the refs of the snapshot whose id (or a unique prefix of it) is id, or the loaded refs if id is
+// empty
+func (p *packImp) snapshotRefs(id string) ([]*refEntry, error) {
+	if id == "" {
+		return p.refs, nil
+	}
+	entries, _, err := readReflog(p.backend)
+	if err != nil {
+		return nil, err
+	}
+	i, err := findSnapshot(entries, id)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := readSnapshotRefs(p.backend, entries[i].sha1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot %s: %w", entries[i].sha1, err)
+	}
+	return refs, nil
+}
+
 // List lists files in the pack
 func (p *packImp) List() ([]string, error) {
 	files := []string{}
@@ -476,44 +888,110 @@ func (p *packImp) List() ([]string, error) {
 }
 
 func (p *packImp) verifyData(sha1 string) error {
-	dataPath, err := getShaPath(p.root, sha1, false)
+	return verifyObject(p.backend, sha1, sha1)
+}
+
+func (p *packImp) verifyDataBkup(sha1 string) error {
+	return verifyObject(p.backend, sha1+bkupSuffix, sha1)
+}
+
+// verifyCopies checks that an object of an append-only pack has as many intact copies (counting its bkup and any
+// repair copies) as its parity calls for; it returns the number of copies which are missing
+func (p *packImp) verifyCopies(sha1 string) (int, error) {
+	intact, err := intactCopies(p.backend, sha1)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	want := 1 + p.parityBits
+	if len(intact) < want {
+		return want - len(intact), fmt.Errorf("only %d of %d copies of %s are intact", len(intact), want, p.backend.ObjectLocation(sha1))
 	}
+	return 0, nil
+}
 
-	actualSha1, err := getSha1(dataPath)
+// verifyObject checks that the named object's contents hash to sha1
+func verifyObject(b Backend, name, sha1 string) error {
+	actualSha1, err := hashObject(b, name)
 	if err != nil {
 		return err
 	}
 	if actualSha1 != sha1 {
-		return fmt.Errorf("%s is corrupt; should be %s but instead is %s", dataPath, sha1, actualSha1)
+		return &CorruptObjectError{Path: b.ObjectLocation(name), Expected: sha1, Actual: actualSha1}
 	}
 	return nil
 }
 
-func (p *packImp) verifyDataBkup(sha1 string) error {
-	dataPath, err := getShaPath(p.root, sha1, false)
+// verifyPointer checks that the refs pointer references the loaded refs, and that all reflog copies are intact
+func (p *packImp) verifyPointer() error {
+	if p.pointerErr != nil {
+		return p.pointerErr
+	}
+	entries, damaged, err := readReflog(p.backend)
 	if err != nil {
 		return err
 	}
-	dataPath += ".bkup"
+	if damaged {
+		return fmt.Errorf("reflog copies are damaged or out of sync")
+	}
+	// the reflog is appended to before the pointer is updated, so an interrupted update may leave newer entries
+	if p.head != "" && !reflogContains(entries, p.head) {
+		return fmt.Errorf("reflog does not contain the current refs %s", p.head)
+	}
+	return nil
+}
 
-	actualSha1, err := getSha1(dataPath)
+// recoverPointer rewrites the refs pointer and all reflog copies based on the refs that were loaded
+func (p *packImp) recoverPointer() error {
+	entries, _, err := readReflog(p.backend)
 	if err != nil {
 		return err
 	}
-	if actualSha1 != sha1 {
-		return fmt.Errorf("%s is corrupt; should be %s but instead is %s", dataPath, sha1, actualSha1)
+	if p.head == "" {
+		return rewriteReflog(p.backend, entries)
+	}
+	if !reflogContains(entries, p.head) {
+		entries = append(entries, reflogEntry{sha1: p.head, time: time.Now()})
 	}
+	err = rewriteReflog(p.backend, entries)
+	if err != nil {
+		return err
+	}
+	err = p.writeRefsPointer(p.head)
+	if err != nil {
+		return err
+	}
+	p.pointerErr = nil
 	return nil
 }
 
-// Verify verifies integrety of backup
-func (p *packImp) Verify() bool {
+// Verify verifies integrety of backup; it stops early with ctx's error once ctx is done
+func (p *packImp) Verify(ctx context.Context) (bool, error) {
 	failed := false
+	fmt.Fprintf(os.Stderr, "verifying refs pointer and reflog... ")
+	err := p.verifyPointer()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAILED: %s\n", err)
+		failed = true
+	} else {
+		fmt.Fprintf(os.Stderr, "OK\n")
+	}
 	for _, ref := range p.refs {
+		err := ctx.Err()
+		if err != nil {
+			return false, err
+		}
 		fmt.Fprintf(os.Stderr, "verifying %s -> %s... ", ref.path, ref.sha1)
-		err := p.verifyData(ref.sha1)
+		if isAppendOnly(p.backend) {
+			_, err = p.verifyCopies(ref.sha1)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "FAILED: %s\n", err)
+				failed = true
+			} else {
+				fmt.Fprintf(os.Stderr, "OK\n")
+			}
+			continue
+		}
+		err = p.verifyData(ref.sha1)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "FAILED: %s\n", err)
 			failed = true
@@ -530,25 +1008,90 @@ func (p *packImp) Verify() bool {
 		}
 		fmt.Fprintf(os.Stderr, "OK\n")
 	}
-	return !failed
+	return !failed, nil
 }
 
-// Recover attempts to recover
-func (p *packImp) Recover() (int, int, int, error) {
+// Recover attempts to recover; it stops early with ctx's error (and the counts so far) once ctx is done
+func (p *packImp) Recover(ctx context.Context) (int, int, int, error) {
 	numOK := 0
 	numRecovered := 0
 	numFailed := 0
+
+	// the packs which objects are fetched from mustn't change while they're being read
+	for _, src := range p.repairFrom {
+		meta, err := readMeta(src)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("failed to read %s/%s: %w", src, metaFileName, err)
+		}
+		if meta.hash != p.meta.hash {
+			return 0, 0, 0, fmt.Errorf("%s uses hash %s, but %s uses %s", src, meta.hash, p.backend, p.meta.hash)
+		}
+		lock, err := acquireLock(src, lockShared)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		defer lock.Release()
+	}
+
+	fmt.Fprintf(os.Stderr, "verifying refs pointer and reflog... ")
+	err := p.verifyPointer()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAILED: %s\n", err)
+		err = p.recoverPointer()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "RECOVERY-FAILED: %s\n", err)
+			numFailed++
+		} else {
+			numRecovered++
+			fmt.Fprintf(os.Stderr, "recovered\n")
+		}
+	} else {
+		numOK++
+		fmt.Fprintf(os.Stderr, "OK\n")
+	}
+
 	for _, ref := range p.refs {
+		err := ctx.Err()
+		if err != nil {
+			return numOK, numRecovered, numFailed, err
+		}
 		fmt.Fprintf(os.Stderr, "verifying %s -> %s... ", ref.path, ref.sha1)
-		err := p.verifyData(ref.sha1)
+		if isAppendOnly(p.backend) {
+			missing, err := p.verifyCopies(ref.sha1)
+			if err == nil {
+				numOK++
+				fmt.Fprintf(os.Stderr, "OK\n")
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "FAILED: %s\n", err)
+			for i := 0; i < missing; i++ {
+				err = addRepairCopy(p.backend, ref.sha1)
+				if err != nil {
+					break
+				}
+			}
+			if err != nil && len(p.repairFrom) > 0 {
+				fmt.Fprintf(os.Stderr, "%s; fetching it from another pack\n", err)
+				err = p.fetchObject(ref.sha1)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "RECOVERY-FAILED: %s\n", err)
+				numFailed++
+			} else {
+				numRecovered++
+				fmt.Fprintf(os.Stderr, "recovered\n")
+			}
+			continue
+		}
+		err = p.verifyData(ref.sha1)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "FAILED: %s\n", err)
 
-			path, err := getShaPath(p.root, ref.sha1, false)
-			if err != nil {
-				return 0, 0, 0, err
+			err = restoreFromBkup(p.backend, ref.sha1)
+			if err != nil && len(p.repairFrom) > 0 {
+				fmt.Fprintf(os.Stderr, "%s; fetching it from another pack\n", err)
+				err = p.fetchObject(ref.sha1)
 			}
-			err = restoreFromBkup(path, ref.sha1)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "RECOVERY-FAILED: %s\n", err)
 				numFailed++
@@ -564,11 +1107,7 @@ func (p *packImp) Recover() (int, int, int, error) {
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "FAILED: %s\n", err)
 
-				path, err := getShaPath(p.root, ref.sha1, false)
-				if err != nil {
-					return 0, 0, 0, err
-				}
-				err = rebuildBkup(path, ref.sha1)
+				err = rebuildBkup(p.backend, ref.sha1)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "RECOVERY-FAILED: %s\n", err)
 					numFailed++
@@ -586,32 +1125,224 @@ func (p *packImp) Recover() (int, int, int, error) {
 	return numOK, numRecovered, numFailed, nil
 }
 
+// fetchObject replaces a damaged (or missing) object with a verified copy fetched from one of the RepairFrom packs,
+// and then restores its redundancy (in an append-only pack, the copy is stored alongside the damaged one)
+func (p *packImp) fetchObject(sha1 string) error {
+	name := sha1
+	if isAppendOnly(p.backend) {
+		var err error
+		name, err = nextCopyName(p.backend, sha1)
+		if err != nil {
+			return err
+		}
+	}
+	var err error
+	for _, src := range p.repairFrom {
+		err = syncObject(src, p.backend, sha1, name)
+		if err == nil {
+			break
+		}
+		fmt.Fprintf(os.Stderr, "WARNING: failed to fetch %s from %s: %s\n", sha1, src, err)
+	}
+	if err != nil {
+		return fmt.Errorf("no other pack holds an intact copy of %s", sha1)
+	}
+
+	if isAppendOnly(p.backend) {
+		missing, _ := p.verifyCopies(sha1)
+		for i := 0; i < missing; i++ {
+			err = addRepairCopy(p.backend, sha1)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if p.parityBits > 0 && p.verifyDataBkup(sha1) != nil {
+		return rebuildBkup(p.backend, sha1)
+	}
+	return nil
+}
+
 // Restore overwrites the local file with the backed up file
-func (p *packImp) Restore(aliasPath, localPath string) error {
+func (p *packImp) Restore(ctx context.Context, aliasPath, localPath string) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
 	ref, ok := p.refIndex[aliasPath]
 	if !ok {
-		return fmt.Errorf("%s not in backup", aliasPath)
+		return fmt.Errorf("%s %w", aliasPath, ErrNotInBackup)
 	}
+	return p.restoreRef(ref, localPath)
+}
 
-	bkupPath, err := getShaPath(p.root, ref.sha1, false)
+// restoreRef replaces localPath with the file which ref records; the file is written to a temporary file alongside it,
+// and only renamed over localPath once it has been synced and verified, so a failed restore keeps the original
+func (p *packImp) restoreRef(ref *refEntry, localPath string) error {
+	err := os.MkdirAll(filepath.Dir(localPath), 0700)
 	if err != nil {
 		return err
 	}
 
-	actualSha1, err := getSha1(bkupPath)
+	// every copy is tried in turn, each being verified as it's written: the object, its bkup (or repair copies), and
+	// then the RepairFrom packs. Nothing is written to the pack, so this works on a write-protected one.
+	var firstErr, lastErr error
+	for _, b := range append([]Backend{p.backend}, p.repairFrom...) {
+		names, err := objectCopies(b, ref.sha1)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if lastErr != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: %s; restoring %s from %s instead\n", lastErr, ref.path, b.ObjectLocation(name))
+			}
+			if ref.isSymlink() {
+				lastErr = restoreSymlink(b, name, ref, localPath)
+			} else {
+				lastErr = restoreFile(b, name, ref, localPath)
+			}
+			if !errors.Is(lastErr, ErrCorruptObject) {
+				return lastErr
+			}
+			if firstErr == nil {
+				firstErr = lastErr
+			}
+		}
+	}
+	if firstErr == nil {
+		return fmt.Errorf("%s: %w", p.backend.ObjectLocation(ref.sha1), os.ErrNotExist)
+	}
+	// the copy in the pack itself is the one worth reporting
+	return firstErr
+}
+
+// createRestoreTemp creates the temporary file which a file restored to localPath is written to
+func createRestoreTemp(localPath string) (*os.File, error) {
+	return ioutil.TempFile(filepath.Dir(localPath), "."+filepath.Base(localPath)+".restoring-")
+}
+
+// restoreFile writes an object to a temporary file (verifying it on the way), syncs it, checks that what was written
+// matches, and renames it over localPath
+func restoreFile(b Backend, name string, ref *refEntry, localPath string) error {
+	perm := ref.perm()
+	if ref.mode == 0 {
+		// keep the permissions of the file being replaced
+		info, err := os.Stat(localPath)
+		if err == nil {
+			perm = info.Mode().Perm()
+		}
+	}
+
+	r, err := b.GetObject(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := createRestoreTemp(localPath)
 	if err != nil {
 		return err
 	}
-	if ref.sha1 != actualSha1 {
-		return fmt.Errorf("bkup %s is corrupt; expected %s but actual hash is %s", bkupPath, ref.sha1, actualSha1)
+	tmpPath := f.Name()
+	err = writeRestored(f, r, b.ObjectLocation(name), ref)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// re-read what was written, to catch a write which was silently lost (e.g. by a flaky USB link)
+		var written string
+		written, err = getSha1(tmpPath)
+		if err == nil && written != ref.sha1 {
+			err = fmt.Errorf("restored copy of %s doesn't match the backed up one: expected %s but got %s", ref.path, ref.sha1, written)
+		}
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, perm)
+	}
+	if err == nil {
+		err = crashPoint("rename " + localPath)
 	}
+	if err == nil {
+		err = os.Rename(tmpPath, localPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(localPath))
+}
 
-	err = os.MkdirAll(filepath.Dir(localPath), 0700)
+// writeRestored copies an object (read from location) into f, and syncs it; it returns an error if the object
+// doesn't match ref
+func writeRestored(f *os.File, r io.Reader, location string, ref *refEntry) error {
+	h := sha1.New()
+	_, err := io.Copy(io.MultiWriter(&restoreWriter{f: f}, h), r)
 	if err != nil {
 		return err
 	}
+	actual := fmt.Sprintf("%x", h.Sum(nil))
+	if actual != ref.sha1 {
+		return &CorruptObjectError{Path: location, Expected: ref.sha1, Actual: actual}
+	}
+	return f.Sync()
+}
+
+// restoreWriter writes a restored file; tests use crashPoint to make it fail (e.g. as if the disk were full)
+type restoreWriter struct {
+	f *os.File
+}
+
+func (w *restoreWriter) Write(p []byte) (int, error) {
+	err := crashPoint("write " + w.f.Name())
+	if err != nil {
+		return 0, err
+	}
+	return w.f.Write(p)
+}
+
+// restoreSymlink replaces localPath with a symlink to the target held by an object, once it has been verified
+func restoreSymlink(b Backend, name string, ref *refEntry, localPath string) error {
+	r, err := b.GetObject(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	target, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	actual := fmt.Sprintf("%x", sha1.Sum(target))
+	if actual != ref.sha1 {
+		return &CorruptObjectError{Path: b.ObjectLocation(name), Expected: ref.sha1, Actual: actual}
+	}
+
+	// the symlink is created under a temporary name, so it can be renamed over localPath
+	f, err := createRestoreTemp(localPath)
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	f.Close()
+	err = os.Remove(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = os.Symlink(string(target), tmpPath)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, localPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(localPath))
+}
 
-	return fileutil.CopyFileContents(bkupPath, localPath)
+// isCleanPath returns true if p is a clean absolute path (as recorded by addMeta), so it has no .. components
+func isCleanPath(p string) bool {
+	return strings.HasPrefix(p, "/") && path.Clean(p) == p
 }
 
 func encodePath(path string) string {
@@ -626,27 +1357,31 @@ func decodePath(encPath string) (string, error) {
 	return string(data), nil
 }
 
-func (p *packImp) addMeta(path, sha1 string) error {
+func (p *packImp) addMeta(path, sha1 string, size, modTime int64) error {
 
 	absPath, err := filepath.Abs(path)
 	if err != nil {
 		return err
 	}
 	if !strings.HasPrefix(absPath, "/") {
-		panic("bad path")
+		return fmt.Errorf("%s is not an absolute path", path)
 	}
 
 	// keep existing if up to date
 	if ref, ok := p.refIndex[absPath]; ok && ref.sha1 == sha1 {
 		if ref.path != absPath {
-			panic("ref path is corrupt")
+			return fmt.Errorf("%w: entry for %s is recorded as %s", ErrRefsCorrupt, absPath, ref.path)
 		}
+		ref.size = size
+		ref.modTime = modTime
 		return nil
 	}
 
 	ref := &refEntry{
-		path: absPath,
-		sha1: sha1,
+		path:    absPath,
+		sha1:    sha1,
+		size:    size,
+		modTime: modTime,
 	}
 	p.refs = append(p.refs, ref)
 	p.refIndex[absPath] = ref
@@ -1,11 +1,34 @@
 package pack
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/alexcb/acbup/util/fileutil"
 	"github.com/stretchr/testify/assert"
 )
 
+func verifyPack(t *testing.T, p Pack) bool {
+	ok, err := p.Verify(context.Background())
+	assert.Nil(t, err)
+	return ok
+}
+
 func TestEncodeDecode(t *testing.T) {
 	path := "/some/path/to/file.txt"
 	s := encodePath(path)
@@ -13,3 +36,1514 @@ func TestEncodeDecode(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, path, s2)
 }
+
+func TestInitWritesMeta(t *testing.T) {
+	root := t.TempDir()
+	_, err := New(NewLocalBackend(root), Options{ParityBits: 1})
+	assert.True(t, errors.Is(err, errNoPack))
+
+	id, err := Init(NewLocalBackend(root), 1, false)
+	assert.Nil(t, err)
+	p, err := New(NewLocalBackend(root), Options{ParityBits: 1, PackID: id})
+	assert.Nil(t, err)
+	assert.Nil(t, p.Close())
+
+	m, err := readMeta(NewLocalBackend(root))
+	assert.Nil(t, err)
+	assert.Equal(t, currentVersion, m.version)
+	assert.Equal(t, hashSha1, m.hash)
+	assert.Equal(t, 1, m.parityBits)
+	assert.Equal(t, id, m.id)
+
+	p, err = New(NewLocalBackend(root), Options{ReadOnly: true, ParityBits: 1})
+	assert.Nil(t, err)
+	assert.Nil(t, p.Close())
+
+	_, err = New(NewLocalBackend(root), Options{ParityBits: 1, PackID: "0123"})
+	assert.NotNil(t, err)
+
+	_, err = Init(NewLocalBackend(root), 1, false)
+	assert.NotNil(t, err)
+}
+
+func TestNewRefusesUnknownVersion(t *testing.T) {
+	root := t.TempDir()
+	m, err := newPackMeta(0)
+	assert.Nil(t, err)
+	m.version = currentVersion + 1
+	assert.Nil(t, writeMeta(NewLocalBackend(root), m))
+
+	_, err = New(NewLocalBackend(root), Options{})
+	assert.NotNil(t, err)
+}
+
+func TestUpgradeThreeLevelLayout(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(t.TempDir(), "a.txt")
+	assert.Nil(t, ioutil.WriteFile(src, []byte("alpha\n"), 0600))
+
+	_, err := Init(NewLocalBackend(root), 0, false)
+	assert.Nil(t, err)
+	p, err := New(NewLocalBackend(root), Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, p.AddFile(context.Background(), src, src))
+	assert.Nil(t, p.Close())
+
+	// rewrite the pack into the original three-level layout without a meta file
+	const hash = "d046cd9b7ffb7661e449683313d41f6fc33e3130"
+	assert.Nil(t, os.Remove(filepath.Join(root, metaFileName)))
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "data", "d0", "46", "cd"), 0700))
+	assert.Nil(t, os.Rename(filepath.Join(root, "data", "d0", "46", hash), filepath.Join(root, "data", "d0", "46", "cd", hash)))
+
+	_, err = New(NewLocalBackend(root), Options{})
+	assert.Equal(t, errUnversionedPack, err)
+
+	assert.Nil(t, Upgrade(NewLocalBackend(root), 0))
+	assert.True(t, fileutil.FileExists(filepath.Join(root, "data", "d0", "46", hash)))
+
+	p, err = New(NewLocalBackend(root), Options{ReadOnly: true})
+	assert.Nil(t, err)
+	assert.Nil(t, p.Restore(context.Background(), src, src+".restored"))
+	assert.Nil(t, p.Close())
+}
+
+func TestReflogChecksum(t *testing.T) {
+	e := reflogEntry{sha1: "d046cd9b7ffb7661e449683313d41f6fc33e3130", time: time.Unix(1600000000, 0)}
+	entries, numInvalid := parseReflog([]byte(e.String()))
+	assert.Equal(t, 0, numInvalid)
+	assert.Equal(t, []reflogEntry{e}, entries)
+
+	corrupt := []byte(e.String())
+	corrupt[3] = 'f'
+	entries, numInvalid = parseReflog(corrupt)
+	assert.Equal(t, 1, numInvalid)
+	assert.Len(t, entries, 0)
+}
+
+func TestRefsPointerFallsBackToReflog(t *testing.T) {
+	root := t.TempDir()
+	dir := t.TempDir()
+	_, err := Init(NewLocalBackend(root), 0, false)
+	assert.Nil(t, err)
+
+	a := filepath.Join(dir, "a.txt")
+	assert.Nil(t, ioutil.WriteFile(a, []byte("alpha\n"), 0600))
+	p, err := New(NewLocalBackend(root), Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, p.AddFile(context.Background(), a, a))
+	assert.Nil(t, p.Close())
+
+	// destroy the pointer and one of the reflog copies
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "refs"), []byte("garbage"), 0600))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, reflogCopies[0]), []byte("garbage\n"), 0600))
+
+	p, err = New(NewLocalBackend(root), Options{ReadOnly: true})
+	assert.Nil(t, err)
+	files, err := p.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{a}, files)
+	assert.False(t, verifyPack(t, p))
+	assert.Nil(t, p.Close())
+
+	p, err = New(NewLocalBackend(root), Options{})
+	assert.Nil(t, err)
+	_, numRecovered, numFailed, err := p.Recover(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, numRecovered)
+	assert.Equal(t, 0, numFailed)
+	assert.Nil(t, p.Close())
+
+	p, err = New(NewLocalBackend(root), Options{ReadOnly: true})
+	assert.Nil(t, err)
+	assert.True(t, verifyPack(t, p))
+	assert.Nil(t, p.Close())
+}
+
+func TestRebuildIndex(t *testing.T) {
+	root := t.TempDir()
+	dir := t.TempDir()
+	_, err := Init(NewLocalBackend(root), 1, false)
+	assert.Nil(t, err)
+
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "b.txt")
+	assert.Nil(t, ioutil.WriteFile(a, []byte("alpha\n"), 0600))
+	assert.Nil(t, ioutil.WriteFile(b, []byte("bravo\n"), 0600))
+
+	p, err := New(NewLocalBackend(root), Options{ParityBits: 1})
+	assert.Nil(t, err)
+	assert.Nil(t, p.AddFile(context.Background(), a, a))
+	assert.Nil(t, p.Close())
+
+	p, err = New(NewLocalBackend(root), Options{ParityBits: 1})
+	assert.Nil(t, err)
+	assert.Nil(t, p.AddFile(context.Background(), b, b))
+	assert.Nil(t, p.Close())
+
+	// lose the pointer, the reflog, and the newest refs (both copies), leaving b.txt's object orphaned
+	refsSha1, err := readRefsPointer(NewLocalBackend(root))
+	assert.Nil(t, err)
+	refsPath, err := getShaPath(root, refsSha1, false)
+	assert.Nil(t, err)
+	for _, path := range []string{filepath.Join(root, "refs"), refsPath, refsPath + ".bkup", filepath.Join(root, reflogCopies[0]), filepath.Join(root, reflogCopies[1])} {
+		assert.Nil(t, os.Remove(path))
+	}
+
+	numSnapshots, numOrphans, err := RebuildIndex(context.Background(), NewLocalBackend(root), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, numSnapshots)
+	assert.Equal(t, 1, numOrphans)
+
+	p, err = New(NewLocalBackend(root), Options{ReadOnly: true, ParityBits: 1})
+	assert.Nil(t, err)
+	files, err := p.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{lostAndFoundPrefix + "bb596efe9e3023a502013767a0559a94a5eea4bc", a}, files)
+	assert.True(t, verifyPack(t, p))
+	assert.Nil(t, p.Close())
+}
+
+func TestLocking(t *testing.T) {
+	root := t.TempDir()
+	_, err := Init(NewLocalBackend(root), 0, false)
+	assert.Nil(t, err)
+
+	reader1, err := New(NewLocalBackend(root), Options{ReadOnly: true})
+	assert.Nil(t, err)
+	reader2, err := New(NewLocalBackend(root), Options{ReadOnly: true})
+	assert.Nil(t, err)
+
+	var lockedErr *LockedError
+	_, err = New(NewLocalBackend(root), Options{})
+	assert.True(t, errors.As(err, &lockedErr), "got %v", err)
+
+	assert.Nil(t, reader1.Close())
+	assert.Nil(t, reader2.Close())
+
+	writer, err := New(NewLocalBackend(root), Options{})
+	assert.Nil(t, err)
+	_, err = New(NewLocalBackend(root), Options{ReadOnly: true})
+	assert.True(t, errors.As(err, &lockedErr), "got %v", err)
+	_, err = New(NewLocalBackend(root), Options{})
+	assert.True(t, errors.As(err, &lockedErr), "got %v", err)
+	assert.Nil(t, writer.Close())
+
+	// a lock left behind by a process which no longer exists is taken over
+	stale := fmt.Sprintf("pid=%d\nhost=%s\ntime=%s\n", 1<<30, hostname(), time.Now().UTC().Format(time.RFC3339))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, locksDirName, exclusiveLockName), []byte(stale), 0600))
+	writer, err = New(NewLocalBackend(root), Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Close())
+
+	// as is a lock from another host whose heartbeat has expired
+	other := fmt.Sprintf("pid=%d\nhost=%s\ntime=%s\n", os.Getpid(), "some-other-host", time.Now().UTC().Format(time.RFC3339))
+	lockPath := filepath.Join(root, locksDirName, sharedLockPrefix+"some-other-host")
+	assert.Nil(t, ioutil.WriteFile(lockPath, []byte(other), 0600))
+	_, err = New(NewLocalBackend(root), Options{})
+	assert.True(t, errors.As(err, &lockedErr), "got %v", err)
+	expired := time.Now().Add(-2 * staleLockTimeout)
+	assert.Nil(t, os.Chtimes(lockPath, expired, expired))
+	writer, err = New(NewLocalBackend(root), Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Close())
+}
+
+func TestLostLock(t *testing.T) {
+	b := NewMemoryBackend()
+	_, err := Init(b, 0, false)
+	assert.Nil(t, err)
+	name := path.Join(locksDirName, exclusiveLockName)
+
+	lock, err := acquireLock(b, lockExclusive)
+	assert.Nil(t, err)
+	assert.True(t, lock.refresh())
+
+	// another process removes the lock as stale (e.g. while this one was suspended), and takes it over
+	assert.Nil(t, b.RemoveFile(name))
+	assert.False(t, lock.refresh())
+	other := []byte(fmt.Sprintf("pid=%d\nhost=%s\ntime=%s\n", os.Getpid(), "some-other-host", time.Now().UTC().Format(time.RFC3339)))
+	assert.Nil(t, b.CreateFile(name, other))
+
+	// the heartbeat doesn't bring the lock back, and releasing it leaves the other process's lock alone
+	assert.False(t, lock.refresh())
+	assert.NotNil(t, lock.Release())
+	data, err := b.ReadFile(name)
+	assert.Nil(t, err)
+	assert.Equal(t, other, data)
+
+	// a lock which is taken over between heartbeats is noticed when it's released
+	assert.Nil(t, b.RemoveFile(name))
+	lock, err = acquireLock(b, lockExclusive)
+	assert.Nil(t, err)
+	assert.Nil(t, b.WriteFile(name, other))
+	assert.NotNil(t, lock.Release())
+	data, err = b.ReadFile(name)
+	assert.Nil(t, err)
+	assert.Equal(t, other, data)
+}
+
+// racingBackend runs race once, as a lock file is first inspected, as if another process acted at the same time
+type racingBackend struct {
+	Backend
+	race func()
+}
+
+func (b *racingBackend) StatFile(name string) (Info, error) {
+	if b.race != nil {
+		race := b.race
+		b.race = nil
+		race()
+	}
+	return b.Backend.StatFile(name)
+}
+
+func TestStaleLockRace(t *testing.T) {
+	b := NewMemoryBackend()
+	_, err := Init(b, 0, false)
+	assert.Nil(t, err)
+	name := path.Join(locksDirName, exclusiveLockName)
+	stale := []byte(fmt.Sprintf("pid=%d\nhost=%s\ntime=%s\n", 1<<30, hostname(), time.Now().UTC().Format(time.RFC3339)))
+	other := []byte(fmt.Sprintf("pid=%d\nhost=%s\ntime=%s\n", os.Getpid(), "some-other-host", time.Now().UTC().Format(time.RFC3339)))
+	var lockedErr *LockedError
+
+	// another process takes over the stale lock after we judged it stale, but before we replace it
+	assert.Nil(t, b.WriteFile(name, stale))
+	racing := &racingBackend{Backend: b, race: func() {
+		assert.Nil(t, b.SwapFile(name, stale, other))
+	}}
+	_, err = acquireLock(racing, lockExclusive)
+	assert.True(t, errors.As(err, &lockedErr), "got %v", err)
+	data, err := b.ReadFile(name)
+	assert.Nil(t, err)
+	assert.Equal(t, other, data)
+
+	// a stale lock which is taken over before it's removed is left alone
+	assert.Nil(t, b.WriteFile(name, stale))
+	racing.race = func() {
+		assert.Nil(t, b.SwapFile(name, stale, other))
+	}
+	_, err = acquireLock(racing, lockShared)
+	assert.True(t, errors.As(err, &lockedErr), "got %v", err)
+	data, err = b.ReadFile(name)
+	assert.Nil(t, err)
+	assert.Equal(t, other, data)
+}
+
+func TestCheckpointResume(t *testing.T) {
+	root := t.TempDir()
+	dir := t.TempDir()
+	_, err := Init(NewLocalBackend(root), 0, false)
+	assert.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.txt", i)), []byte(fmt.Sprintf("%d\n", i)), 0600))
+	}
+
+	// simulate being interrupted after three files
+	p, err := New(NewLocalBackend(root), Options{CheckpointFiles: 3})
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	numAdded := 0
+	origCrashPoint := crashPoint
+	crashPoint = func(step string) error {
+		if strings.HasPrefix(step, "rename ") && strings.Contains(step, "/data/") {
+			numAdded++
+			if numAdded == 3 {
+				cancel()
+			}
+		}
+		return nil
+	}
+	err = p.AddDir(ctx, dir, dir)
+	crashPoint = origCrashPoint
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Nil(t, p.Checkpoint())
+	assert.Nil(t, p.Abort())
+
+	p, err = New(NewLocalBackend(root), Options{ReadOnly: true})
+	assert.Nil(t, err)
+	assert.True(t, p.(*packImp).headPartial)
+	files, err := p.List()
+	assert.Nil(t, err)
+	assert.Len(t, files, 3)
+	assert.Nil(t, p.Close())
+
+	p, err = New(NewLocalBackend(root), Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, p.AddDir(context.Background(), dir, dir))
+	assert.Nil(t, p.Close())
+
+	p, err = New(NewLocalBackend(root), Options{ReadOnly: true})
+	assert.Nil(t, err)
+	assert.False(t, p.(*packImp).headPartial)
+	files, err = p.List()
+	assert.Nil(t, err)
+	assert.Len(t, files, 5)
+	assert.True(t, verifyPack(t, p))
+	assert.Nil(t, p.Close())
+}
+
+func TestCheckpointVerifiesUnchanged(t *testing.T) {
+	root := t.TempDir()
+	dir := t.TempDir()
+	_, err := Init(NewLocalBackend(root), 0, false)
+	assert.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.txt", i)), []byte(fmt.Sprintf("%d\n", i)), 0600))
+	}
+	p, err := New(NewLocalBackend(root), Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, p.AddDir(context.Background(), dir, dir))
+	assert.Nil(t, p.Close())
+
+	// files recorded by a complete snapshot are checked against their stored copies, even after a checkpoint (or
+	// when resuming from one)
+	for _, interrupted := range []bool{false, true} {
+		const hash = "a3db5c13ff90a36963278c6a39e4ee3c22e2a436" // 3.txt
+		objPath, err := getShaPath(root, hash, false)
+		assert.Nil(t, err)
+		assert.Nil(t, ioutil.WriteFile(objPath, []byte("damaged"), 0600))
+
+		if interrupted {
+			p, err = New(NewLocalBackend(root), Options{})
+			assert.Nil(t, err)
+			newFile := filepath.Join(dir, "5.txt")
+			assert.Nil(t, ioutil.WriteFile(newFile, []byte("5\n"), 0600))
+			assert.Nil(t, p.AddFile(context.Background(), newFile, newFile))
+			assert.Nil(t, p.Checkpoint())
+			assert.Nil(t, p.Abort())
+		}
+		p, err = New(NewLocalBackend(root), Options{CheckpointFiles: 1})
+		assert.Nil(t, err)
+		assert.Equal(t, interrupted, p.(*packImp).headPartial)
+		assert.Nil(t, p.AddDir(context.Background(), dir, dir))
+		assert.Nil(t, p.Close())
+
+		p, err = New(NewLocalBackend(root), Options{ReadOnly: true})
+		assert.Nil(t, err)
+		assert.True(t, verifyPack(t, p))
+		assert.Nil(t, p.Close())
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	root := t.TempDir()
+	dir := t.TempDir()
+	_, err := Init(NewLocalBackend(root), 0, false)
+	assert.Nil(t, err)
+	a := filepath.Join(dir, "a.txt")
+	assert.Nil(t, ioutil.WriteFile(a, []byte("alpha\n"), 0600))
+
+	p, err := New(NewLocalBackend(root), Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, p.AddFile(context.Background(), a, a))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = p.AddFile(ctx, a, a)
+	assert.True(t, errors.Is(err, context.Canceled), "got %v", err)
+
+	assert.Nil(t, p.Close())
+
+	// corrupt the object
+	const hash = "d046cd9b7ffb7661e449683313d41f6fc33e3130"
+	objPath, err := getShaPath(root, hash, false)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(objPath, []byte("bravo\n"), 0600))
+
+	p, err = New(NewLocalBackend(root), Options{ReadOnly: true})
+	assert.Nil(t, err)
+	err = p.Restore(context.Background(), "/not/there", filepath.Join(dir, "b.txt"))
+	assert.True(t, errors.Is(err, ErrNotInBackup), "got %v", err)
+	var corruptErr *CorruptObjectError
+	err = p.Restore(context.Background(), a, filepath.Join(dir, "b.txt"))
+	assert.True(t, errors.Is(err, ErrCorruptObject), "got %v", err)
+	assert.True(t, errors.As(err, &corruptErr))
+	assert.Equal(t, hash, corruptErr.Expected)
+	assert.Nil(t, p.Close())
+
+	// point refs at a refs blob with an entry that isn't a sha1
+	assert.Nil(t, os.Remove(filepath.Join(root, reflogCopies[0])))
+	assert.Nil(t, os.Remove(filepath.Join(root, reflogCopies[1])))
+	bad := []byte(encodePath(a) + " not-a-sha1\n")
+	badSha1 := fmt.Sprintf("%x", sha1.Sum(bad))
+	badPath, err := getShaPath(root, badSha1, true)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(badPath, bad, 0600))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "refs"), []byte(badSha1), 0600))
+	_, err = New(NewLocalBackend(root), Options{ReadOnly: true})
+	assert.True(t, errors.Is(err, ErrRefsCorrupt), "got %v", err)
+}
+
+// appendWhileStoring appends to path whenever a staged object is written to, up to n times
+func appendWhileStoring(path string, n int) (restore func()) {
+	orig := crashPoint
+	crashPoint = func(step string) error {
+		if n > 0 && strings.HasPrefix(step, "write ") && strings.HasSuffix(step, "/data/object") {
+			n--
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = f.WriteString("more\n")
+			return err
+		}
+		return nil
+	}
+	return func() { crashPoint = orig }
+}
+
+func TestOnChange(t *testing.T) {
+	for _, tc := range []struct {
+		policy   ChangePolicy
+		changes  int
+		stored   bool
+		volatile []VolatileFile
+	}{
+		{policy: ChangeRetry, changes: 1, stored: true, volatile: []VolatileFile{{Attempts: 2, Stored: true}}},
+		{policy: ChangeRetry, changes: 100, stored: true, volatile: []VolatileFile{{Attempts: 3, Stored: true}}},
+		{policy: ChangeStoreAsRead, changes: 1, stored: true, volatile: []VolatileFile{{Attempts: 1, Stored: true}}},
+		{policy: ChangeSkip, changes: 1, stored: false, volatile: []VolatileFile{{Attempts: 1}}},
+		{policy: ChangeFail, changes: 1, stored: false, volatile: []VolatileFile{{Attempts: 1}}},
+		{policy: ChangeFail, changes: 0, stored: true},
+	} {
+		root := t.TempDir()
+		_, err := Init(NewLocalBackend(root), 1, false)
+		assert.Nil(t, err)
+		log := filepath.Join(t.TempDir(), "app.log")
+		assert.Nil(t, ioutil.WriteFile(log, []byte("start\n"), 0600))
+		for i := range tc.volatile {
+			tc.volatile[i].Path = log
+		}
+
+		p, err := New(NewLocalBackend(root), Options{ParityBits: 1, OnChange: tc.policy, ChangeRetries: 2})
+		assert.Nil(t, err)
+		restore := appendWhileStoring(log, tc.changes)
+		err = p.AddFile(context.Background(), log, log)
+		restore()
+		if tc.policy == ChangeFail && tc.changes > 0 {
+			var changedErr *SourceChangedError
+			assert.True(t, errors.Is(err, ErrSourceChanged), "got %v", err)
+			assert.True(t, errors.As(err, &changedErr))
+			assert.Equal(t, log, changedErr.Path)
+		} else {
+			assert.Nil(t, err, "%s", tc.policy)
+		}
+		assert.Equal(t, tc.volatile, p.VolatileFiles(), "%s", tc.policy)
+		assert.Nil(t, p.Close())
+
+		files := assertPackConsistent(t, root, 1)
+		if tc.stored {
+			assert.Equal(t, []string{log}, files, "%s", tc.policy)
+		} else {
+			assert.Len(t, files, 0, "%s", tc.policy)
+		}
+		tmp, err := ioutil.ReadDir(filepath.Join(root, tmpDirName))
+		assert.Nil(t, err)
+		assert.Len(t, tmp, 0, "%s left temp files behind", tc.policy)
+	}
+}
+
+func TestAppendOnly(t *testing.T) {
+	root := t.TempDir()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "a.txt")
+	assert.Nil(t, ioutil.WriteFile(src, []byte("alpha\n"), 0600))
+	const hash = "d046cd9b7ffb7661e449683313d41f6fc33e3130"
+	objectPath := filepath.Join(root, "data", "d0", "46", hash)
+
+	// append_only=true refuses packs which weren't created append-only
+	plain := t.TempDir()
+	_, err := Init(NewLocalBackend(plain), 1, false)
+	assert.Nil(t, err)
+	_, err = New(NewLocalBackend(plain), Options{ParityBits: 1, AppendOnly: true})
+	assert.NotNil(t, err)
+
+	_, err = Init(NewLocalBackend(root), 1, true)
+	assert.Nil(t, err)
+	m, err := readMeta(NewLocalBackend(root))
+	assert.Nil(t, err)
+	assert.True(t, m.appendOnly)
+
+	p, err := New(NewLocalBackend(root), Options{ParityBits: 1, AppendOnly: true})
+	assert.Nil(t, err)
+	assert.Nil(t, p.AddDir(context.Background(), dir, dir))
+	assert.Nil(t, p.Close())
+	for _, name := range []string{objectPath, objectPath + bkupSuffix} {
+		info, err := os.Stat(name)
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0400), info.Mode().Perm(), name)
+	}
+
+	p, err = New(NewLocalBackend(root), Options{ParityBits: 1})
+	assert.Nil(t, err)
+	b := p.(*packImp).backend
+	assert.True(t, errors.Is(b.DeleteObject(hash), ErrAppendOnly))
+	// storing an object which is already intact changes nothing
+	assert.Nil(t, putObject(b, hash, []byte("bravo\n")))
+	assert.Nil(t, verifyObject(b, hash, hash))
+	assert.True(t, errors.Is(b.WriteFile(metaFileName, nil), ErrAppendOnly))
+	assert.True(t, errors.Is(b.WriteFile(reflogCopies[0], nil), ErrAppendOnly))
+	assert.True(t, errors.Is(b.RemoveFile(refsFileName), ErrAppendOnly))
+	assert.True(t, errors.Is(b.WriteFile(refsFileName, []byte(hash)), ErrAppendOnly))
+	assert.Nil(t, p.Close())
+
+	// a damaged object is left in place, and repaired by adding copies
+	assert.Nil(t, os.Chmod(objectPath, 0600))
+	assert.Nil(t, ioutil.WriteFile(objectPath, []byte("damaged\n"), 0600))
+	p, err = New(NewLocalBackend(root), Options{ParityBits: 1})
+	assert.Nil(t, err)
+	assert.False(t, verifyPack(t, p))
+	numOK, numRecovered, numFailed, err := p.Recover(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 1, 0}, []int{numOK, numRecovered, numFailed})
+	assert.True(t, verifyPack(t, p))
+	data, err := ioutil.ReadFile(objectPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "damaged\n", string(data))
+	data, err = ioutil.ReadFile(objectPath + repairSuffix + "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "alpha\n", string(data))
+	restored := filepath.Join(t.TempDir(), "a.txt")
+	assert.Nil(t, p.Restore(context.Background(), src, restored))
+	data, err = ioutil.ReadFile(restored)
+	assert.Nil(t, err)
+	assert.Equal(t, "alpha\n", string(data))
+	assert.Nil(t, p.Close())
+
+	// once every copy is damaged, the next backup stores new copies
+	for _, name := range []string{objectPath + bkupSuffix, objectPath + repairSuffix + "1"} {
+		assert.Nil(t, os.Chmod(name, 0600))
+		assert.Nil(t, ioutil.WriteFile(name, []byte("damaged\n"), 0600))
+	}
+	p, err = New(NewLocalBackend(root), Options{ParityBits: 1})
+	assert.Nil(t, err)
+	assert.Nil(t, p.AddDir(context.Background(), dir, dir))
+	assert.Nil(t, p.Close())
+	p, err = New(NewLocalBackend(root), Options{ReadOnly: true, ParityBits: 1})
+	assert.Nil(t, err)
+	assert.True(t, verifyPack(t, p))
+	assert.Nil(t, p.Close())
+	intact, err := intactCopies(NewLocalBackend(root), hash)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{hash + repairSuffix + "2", hash + repairSuffix + "3"}, intact)
+}
+
+// failingBackend can't store objects, like a disk which has filled up
+type failingBackend struct {
+	Backend
+}
+
+func (b failingBackend) CreateObject() (ObjectWriter, error) {
+	return nil, errors.New("no space left on device")
+}
+
+func TestMirror(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0600))
+	}
+	roots := []string{t.TempDir(), t.TempDir()}
+	full := NewMemoryBackend()
+	backends := []Backend{NewLocalBackend(roots[0]), NewLocalBackend(roots[1]), failingBackend{full}}
+	for _, b := range backends {
+		_, err := Init(b, 1, false)
+		assert.Nil(t, err)
+	}
+
+	for run := 0; run < 2; run++ {
+		var packs []Pack
+		for _, b := range backends {
+			p, err := New(b, Options{ParityBits: 1})
+			assert.Nil(t, err)
+			packs = append(packs, p)
+		}
+		m := NewMirror(packs)
+		assert.Nil(t, m.AddDir(context.Background(), dir, dir))
+		assert.Nil(t, m.Err(0))
+		assert.Nil(t, m.Err(1))
+		assert.NotNil(t, m.Err(2))
+		assert.Nil(t, packs[0].Close())
+		assert.Nil(t, packs[1].Close())
+		assert.Nil(t, packs[2].Abort())
+	}
+
+	// each working destination has its own snapshot of everything
+	for _, root := range roots {
+		p, err := New(NewLocalBackend(root), Options{ReadOnly: true, ParityBits: 1})
+		assert.Nil(t, err)
+		files, err := p.List()
+		assert.Nil(t, err)
+		assert.Equal(t, []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")}, files)
+		assert.True(t, verifyPack(t, p))
+		assert.Nil(t, p.Close())
+	}
+	objects, err := full.ListObjects()
+	assert.Nil(t, err)
+	assert.Len(t, objects, 0)
+
+	// once every destination has failed, there's nothing left to back up to
+	p, err := New(failingBackend{full}, Options{ParityBits: 1})
+	assert.Nil(t, err)
+	m := NewMirror([]Pack{p})
+	assert.True(t, errors.Is(m.AddDir(context.Background(), dir, dir), ErrAllPacksFailed))
+	assert.Nil(t, p.Abort())
+}
+
+func TestSync(t *testing.T) {
+	dir := t.TempDir()
+	root := t.TempDir()
+	from := NewLocalBackend(root)
+	to := NewMemoryBackend()
+	_, err := Init(from, 1, false)
+	assert.Nil(t, err)
+	_, err = Init(to, 0, false)
+	assert.Nil(t, err)
+
+	backup := func(b Backend, parityBits int, name string) {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0600))
+		p, err := New(b, Options{ParityBits: parityBits})
+		assert.Nil(t, err)
+		assert.Nil(t, p.AddFile(context.Background(), filepath.Join(dir, name), "/"+name))
+		assert.Nil(t, p.Close())
+	}
+	list := func(b Backend, parityBits int) []string {
+		p, err := New(b, Options{ReadOnly: true, ParityBits: parityBits})
+		assert.Nil(t, err)
+		assert.True(t, verifyPack(t, p))
+		files, err := p.List()
+		assert.Nil(t, err)
+		assert.Nil(t, p.Close())
+		return files
+	}
+	backup(from, 1, "a.txt")
+
+	// the damaged object is copied from its bkup instead
+	const hash = "cfc7b4885384957ae445bc14914d4588f607651c"
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "data", "cf", "c7", hash), []byte("damaged"), 0600))
+
+	stats, err := Sync(context.Background(), from, to, SyncOptions{DryRun: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Snapshots)
+	assert.Equal(t, 2, stats.Objects)
+	assert.False(t, stats.Merged)
+	assert.Equal(t, []string{}, list(to, 0))
+
+	stats, err = Sync(context.Background(), from, to, SyncOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Snapshots)
+	assert.Equal(t, []string{"/a.txt"}, list(to, 0))
+	stats, err = Sync(context.Background(), from, to, SyncOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, stats.Snapshots)
+
+	// a snapshot which was recorded at a different time is still known to the destination
+	fromEntries, _, err := readReflog(from)
+	assert.Nil(t, err)
+	fromEntries[0].time = fromEntries[0].time.Add(-time.Hour)
+	assert.Nil(t, writeReflog(from, fromEntries))
+	stats, err = Sync(context.Background(), from, to, SyncOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, stats.Snapshots)
+	toEntries, _, err := readReflog(to)
+	assert.Nil(t, err)
+	assert.Len(t, toEntries, 1)
+
+	// both packs gained snapshots of their own; the histories are merged, and so are the files of both heads
+	backup(from, 1, "b.txt")
+	backup(to, 0, "c.txt")
+	stats, err = Sync(context.Background(), from, to, SyncOptions{DryRun: true})
+	assert.Nil(t, err)
+	assert.True(t, stats.Merged)
+	stats, err = Sync(context.Background(), from, to, SyncOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Snapshots)
+	assert.True(t, stats.Merged)
+	assert.Equal(t, []string{"/a.txt", "/b.txt", "/c.txt"}, list(to, 0))
+	fromEntries, _, err = readReflog(from)
+	assert.Nil(t, err)
+	toEntries, _, err = readReflog(to)
+	assert.Nil(t, err)
+	// the destination's own snapshot, and the one merging the two
+	assert.Len(t, toEntries, len(fromEntries)+2)
+	for _, e := range fromEntries[1:] {
+		assert.True(t, containsReflogEntry(toEntries, e))
+	}
+
+	// the merged destination is ahead of the source, so nothing changes when it's synced again
+	stats, err = Sync(context.Background(), from, to, SyncOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, stats.Snapshots)
+	assert.False(t, stats.Merged)
+	assert.Equal(t, []string{"/a.txt", "/b.txt", "/c.txt"}, list(to, 0))
+
+	// a snapshot referencing an object which is missing from every copy is skipped, before anything is copied
+	backup(from, 1, "d.txt")
+	const missingHash = "97e49c6f8f772dd4635dedb68dbf508e876a0ae3"
+	missingPath := filepath.Join(root, "data", missingHash[:2], missingHash[2:4], missingHash)
+	assert.Nil(t, os.Remove(missingPath))
+	assert.Nil(t, os.Remove(missingPath+bkupSuffix))
+	for _, dryRun := range []bool{true, false} {
+		stats, err = Sync(context.Background(), from, to, SyncOptions{DryRun: dryRun})
+		assert.Nil(t, err)
+		assert.Equal(t, 0, stats.Snapshots)
+		assert.Equal(t, 1, stats.Skipped)
+	}
+	entries, _, err := readReflog(to)
+	assert.Nil(t, err)
+	assert.Equal(t, toEntries, entries)
+}
+
+func TestRecoverRepairFrom(t *testing.T) {
+	dir := t.TempDir()
+	root := t.TempDir()
+	damaged := NewLocalBackend(root)
+	mirror := NewMemoryBackend()
+	_, err := Init(damaged, 1, false)
+	assert.Nil(t, err)
+	_, err = Init(mirror, 1, false)
+	assert.Nil(t, err)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a.txt"), 0600))
+	for _, b := range []Backend{damaged, mirror} {
+		p, err := New(b, Options{ParityBits: 1})
+		assert.Nil(t, err)
+		assert.Nil(t, p.AddFile(context.Background(), filepath.Join(dir, "a.txt"), "/a.txt"))
+		assert.Nil(t, p.Close())
+	}
+
+	// both the object and its bkup are damaged, so it can't be recovered without the mirror
+	const hash = "cfc7b4885384957ae445bc14914d4588f607651c"
+	objectPath := filepath.Join(root, "data", "cf", "c7", hash)
+	assert.Nil(t, ioutil.WriteFile(objectPath, []byte("damaged"), 0600))
+	assert.Nil(t, ioutil.WriteFile(objectPath+bkupSuffix, []byte("damaged"), 0600))
+
+	p, err := New(damaged, Options{ParityBits: 1})
+	assert.Nil(t, err)
+	_, _, numFailed, err := p.Recover(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, numFailed)
+	assert.Nil(t, p.Close())
+
+	p, err = New(damaged, Options{ParityBits: 1, RepairFrom: []Backend{mirror}})
+	assert.Nil(t, err)
+	numOK, numRecovered, numFailed, err := p.Recover(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 1, 0}, []int{numOK, numRecovered, numFailed})
+	assert.Nil(t, p.Close())
+
+	p, err = New(damaged, Options{ReadOnly: true, ParityBits: 1})
+	assert.Nil(t, err)
+	assert.True(t, verifyPack(t, p))
+	assert.Nil(t, p.Close())
+}
+
+func TestBundle(t *testing.T) {
+	dir := t.TempDir()
+	from := NewMemoryBackend()
+	to := NewMemoryBackend()
+	other := NewMemoryBackend()
+	for _, b := range []Backend{from, to, other} {
+		_, err := Init(b, 0, false)
+		assert.Nil(t, err)
+	}
+
+	backupTo := func(b Backend, name string) {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0600))
+		p, err := New(b, Options{})
+		assert.Nil(t, err)
+		assert.Nil(t, p.AddFile(context.Background(), filepath.Join(dir, name), "/"+name))
+		assert.Nil(t, p.Close())
+	}
+	backup := func(name string) {
+		backupTo(from, name)
+	}
+	list := func(b Backend) []string {
+		p, err := New(b, Options{ReadOnly: true})
+		assert.Nil(t, err)
+		assert.True(t, verifyPack(t, p))
+		files, err := p.List()
+		assert.Nil(t, err)
+		assert.Nil(t, p.Close())
+		return files
+	}
+
+	backup("a.txt")
+	var full bytes.Buffer
+	stats, err := CreateBundle(context.Background(), from, &full, BundleOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Snapshots)
+	assert.Equal(t, 2, stats.Objects)
+	head := stats.Head
+
+	stats, err = ApplyBundle(context.Background(), to, bytes.NewReader(full.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Snapshots)
+	assert.Equal(t, []string{"/a.txt"}, list(to))
+	stats, err = ApplyBundle(context.Background(), to, bytes.NewReader(full.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, stats.Snapshots)
+
+	// an incremental bundle only carries what the prerequisite snapshot doesn't have
+	backup("b.txt")
+	var incremental bytes.Buffer
+	stats, err = CreateBundle(context.Background(), from, &incremental, BundleOptions{Since: head[:8]})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Snapshots)
+	assert.Equal(t, 2, stats.Objects)
+
+	_, err = ApplyBundle(context.Background(), other, bytes.NewReader(incremental.Bytes()))
+	assert.True(t, errors.Is(err, ErrMissingPrerequisite))
+	assert.Equal(t, []string{}, list(other))
+
+	damaged := append([]byte{}, incremental.Bytes()...)
+	damaged[len(damaged)-60] ^= 1
+	_, err = ApplyBundle(context.Background(), to, bytes.NewReader(damaged))
+	assert.NotNil(t, err)
+	_, err = ApplyBundle(context.Background(), to, bytes.NewReader(incremental.Bytes()[:incremental.Len()-10]))
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"/a.txt"}, list(to))
+
+	stats, err = ApplyBundle(context.Background(), to, bytes.NewReader(incremental.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Snapshots)
+	assert.False(t, stats.Merged)
+	assert.Equal(t, []string{"/a.txt", "/b.txt"}, list(to))
+	head = stats.Head
+
+	// both packs gained snapshots of their own; the files of both heads are merged
+	backup("c.txt")
+	backupTo(to, "d.txt")
+	incremental.Reset()
+	_, err = CreateBundle(context.Background(), from, &incremental, BundleOptions{Since: head[:8]})
+	assert.Nil(t, err)
+	stats, err = ApplyBundle(context.Background(), to, bytes.NewReader(incremental.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Snapshots)
+	assert.True(t, stats.Merged)
+	assert.Equal(t, []string{"/a.txt", "/b.txt", "/c.txt", "/d.txt"}, list(to))
+
+	_, err = CreateBundle(context.Background(), from, ioutil.Discard, BundleOptions{Since: "0000"})
+	assert.True(t, errors.Is(err, ErrUnknownSnapshot))
+}
+
+func TestExport(t *testing.T) {
+	dir := t.TempDir()
+	root := t.TempDir()
+	b := NewLocalBackend(root)
+	_, err := Init(b, 1, false)
+	assert.Nil(t, err)
+
+	modTime := time.Unix(1600000000, 123456789)
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	for _, name := range []string{"a.txt", "sub/b.txt"} {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, ioutil.WriteFile(path, []byte(name), 0600))
+		assert.Nil(t, os.Chtimes(path, modTime, modTime))
+	}
+	p, err := New(b, Options{ParityBits: 1})
+	assert.Nil(t, err)
+	assert.Nil(t, p.AddDir(context.Background(), dir, "/files"))
+	assert.Nil(t, p.Close())
+	entries, _, err := readReflog(b)
+	assert.Nil(t, err)
+	first := entries[0].sha1
+
+	// a second snapshot, which the first can still be exported from
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "c.txt"), []byte("c.txt"), 0600))
+	p, err = New(b, Options{ParityBits: 1})
+	assert.Nil(t, err)
+	assert.Nil(t, p.AddDir(context.Background(), dir, "/files"))
+	assert.Nil(t, p.Close())
+
+	readTar := func(r io.Reader) map[string]string {
+		files := map[string]string{}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return files
+			}
+			assert.Nil(t, err)
+			data, err := ioutil.ReadAll(tr)
+			assert.Nil(t, err)
+			files[hdr.Name] = string(data)
+			if hdr.Name == "sub/b.txt" {
+				assert.True(t, modTime.Equal(hdr.ModTime))
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	stats, err := Export(context.Background(), b, &buf, ExportOptions{Format: ExportTar})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, stats.Files)
+	assert.Equal(t, map[string]string{"files/a.txt": "a.txt", "files/c.txt": "c.txt", "files/sub/b.txt": "sub/b.txt"}, readTar(&buf))
+
+	buf.Reset()
+	_, err = Export(context.Background(), b, &buf, ExportOptions{Snapshot: first[:10], Format: ExportTarGz, Prefix: "/files/"})
+	assert.Nil(t, err)
+	gr, err := gzip.NewReader(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"a.txt": "a.txt", "sub/b.txt": "sub/b.txt"}, readTar(gr))
+
+	buf.Reset()
+	_, err = Export(context.Background(), b, &buf, ExportOptions{Format: ExportZip, Prefix: "/files/sub"})
+	assert.Nil(t, err)
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(t, err)
+	assert.Len(t, zr.File, 1)
+	assert.Equal(t, "b.txt", zr.File[0].Name)
+	assert.True(t, modTime.Truncate(time.Second).Equal(zr.File[0].Modified.Truncate(time.Second)))
+
+	_, err = Export(context.Background(), b, ioutil.Discard, ExportOptions{Format: ExportTar, Prefix: "/nope"})
+	assert.True(t, errors.Is(err, ErrNotInBackup))
+
+	// a corrupt object is exported from its .bkup instead
+	h := sha1.Sum([]byte("sub/b.txt"))
+	bHash := fmt.Sprintf("%x", h)
+	objPath := filepath.Join(root, "data", bHash[:2], bHash[2:4], bHash)
+	assert.Nil(t, ioutil.WriteFile(objPath, []byte("damaged"), 0600))
+	buf.Reset()
+	_, err = Export(context.Background(), b, &buf, ExportOptions{Format: ExportTar, Prefix: "/files/sub"})
+	assert.Nil(t, err)
+	tr := tar.NewReader(&buf)
+	_, err = tr.Next()
+	assert.Nil(t, err)
+	data, err := ioutil.ReadAll(tr)
+	assert.Nil(t, err)
+	assert.Equal(t, "sub/b.txt", string(data))
+
+	// and stops the export once no intact copy is left
+	assert.Nil(t, ioutil.WriteFile(objPath+".bkup", []byte("damaged"), 0600))
+	_, err = Export(context.Background(), b, ioutil.Discard, ExportOptions{Format: ExportTar})
+	assert.True(t, errors.Is(err, ErrCorruptObject))
+}
+
+func TestImportTar(t *testing.T) {
+	dir := t.TempDir()
+	b := NewMemoryBackend()
+	_, err := Init(b, 1, false)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "new.txt"), []byte("new"), 0600))
+	p, err := New(b, Options{ParityBits: 1})
+	assert.Nil(t, err)
+	assert.Nil(t, p.AddFile(context.Background(), filepath.Join(dir, "new.txt"), "/new.txt"))
+	assert.Nil(t, p.Close())
+	head, err := readRefsPointer(b)
+	assert.Nil(t, err)
+
+	modTime := time.Unix(1500000000, 0)
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	add := func(hdr *tar.Header, data string) {
+		hdr.ModTime = modTime
+		hdr.Size = int64(len(data))
+		assert.Nil(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(data))
+		assert.Nil(t, err)
+	}
+	add(&tar.Header{Typeflag: tar.TypeDir, Name: "./bin/", Mode: 0755}, "")
+	add(&tar.Header{Typeflag: tar.TypeReg, Name: "./bin/run", Mode: 0755}, "old")
+	add(&tar.Header{Typeflag: tar.TypeReg, Name: "./bin/run", Mode: 0700}, "#!/bin/sh")
+	add(&tar.Header{Typeflag: tar.TypeSymlink, Name: "./run", Linkname: "bin/run", Mode: 0777}, "")
+	add(&tar.Header{Typeflag: tar.TypeLink, Name: "./bin/run2", Linkname: "./bin/run", Mode: 0700}, "")
+	add(&tar.Header{Typeflag: tar.TypeFifo, Name: "./fifo", Mode: 0600}, "")
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, gw.Close())
+
+	stats, err := ImportTar(context.Background(), b, bytes.NewReader(buf.Bytes()), ImportOptions{Alias: "/old/host/", Time: modTime})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, stats.Files)
+	assert.Equal(t, 1, stats.Skipped)
+
+	// the archive is older than the current snapshot, which is kept
+	pointer, err := readRefsPointer(b)
+	assert.Nil(t, err)
+	assert.Equal(t, head, pointer)
+	entries, _, err := readReflog(b)
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Snapshot, entries[0].sha1)
+	assert.Equal(t, modTime.Unix(), entries[0].time.Unix())
+
+	refs, err := readRefsObject(b, stats.Snapshot)
+	assert.Nil(t, err)
+	index := buildRefIndex(refs)
+	assert.Equal(t, int64(modeRegular|0700), index["/old/host/bin/run"].mode)
+	assert.Equal(t, index["/old/host/bin/run"].sha1, index["/old/host/bin/run2"].sha1)
+	assert.True(t, index["/old/host/run"].isSymlink())
+	assert.Equal(t, modTime.UnixNano(), index["/old/host/run"].modTime)
+
+	// the modes and symlinks survive an export
+	buf.Reset()
+	_, err = Export(context.Background(), b, &buf, ExportOptions{Snapshot: stats.Snapshot, Format: ExportTar, Prefix: "/old/host"})
+	assert.Nil(t, err)
+	exported := buf.Bytes()
+	tr := tar.NewReader(bytes.NewReader(exported))
+	headers := map[string]*tar.Header{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		headers[hdr.Name] = hdr
+	}
+	assert.Len(t, headers, 3)
+	assert.Equal(t, int64(0700), headers["bin/run"].Mode)
+	assert.Equal(t, byte(tar.TypeSymlink), headers["run"].Typeflag)
+	assert.Equal(t, "bin/run", headers["run"].Linkname)
+
+	// an archive newer than every snapshot becomes the current one, and is restored with its modes and symlinks
+	stats, err = ImportTar(context.Background(), b, bytes.NewReader(exported), ImportOptions{Alias: "/restored"})
+	assert.Nil(t, err)
+	pointer, err = readRefsPointer(b)
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Snapshot, pointer)
+	p, err = New(b, Options{ReadOnly: true, ParityBits: 1})
+	assert.Nil(t, err)
+	assert.True(t, verifyPack(t, p))
+	assert.Nil(t, p.Restore(context.Background(), "/restored/bin/run", filepath.Join(dir, "bin", "run")))
+	assert.Nil(t, p.Restore(context.Background(), "/restored/run", filepath.Join(dir, "run")))
+	assert.Nil(t, p.Close())
+	info, err := os.Stat(filepath.Join(dir, "bin", "run"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	target, err := os.Readlink(filepath.Join(dir, "run"))
+	assert.Nil(t, err)
+	assert.Equal(t, "bin/run", target)
+}
+
+func TestRestoreTree(t *testing.T) {
+	dir := t.TempDir()
+	root := t.TempDir()
+	b := NewLocalBackend(root)
+	_, err := Init(b, 0, false)
+	assert.Nil(t, err)
+	for _, name := range []string{"a.txt", "b.log", "sub/c.txt", "sub/cache/d.txt"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, ioutil.WriteFile(path, []byte(name), 0600))
+	}
+	p, err := New(b, Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, p.AddDir(context.Background(), dir, "/files"))
+	assert.Nil(t, p.Close())
+
+	restored := func(opts RestoreOptions) []string {
+		opts.Target = t.TempDir()
+		p, err := New(b, Options{ReadOnly: true})
+		assert.Nil(t, err)
+		stats, err := p.RestoreTree(context.Background(), opts)
+		assert.Nil(t, err)
+		assert.Nil(t, p.Close())
+		var files []string
+		assert.Nil(t, filepath.Walk(opts.Target, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				data, err := ioutil.ReadFile(path)
+				assert.Nil(t, err)
+				assert.True(t, strings.HasSuffix(filepath.ToSlash(path), "/files/"+string(data)))
+				files = append(files, string(data))
+			}
+			return err
+		}))
+		assert.Equal(t, len(files), stats.Files)
+		return files
+	}
+	assert.Equal(t, []string{"a.txt", "b.log", "sub/c.txt", "sub/cache/d.txt"}, restored(RestoreOptions{}))
+	assert.Equal(t, []string{"sub/c.txt", "sub/cache/d.txt"}, restored(RestoreOptions{Prefixes: []string{"/files/sub/"}}))
+	assert.Equal(t, []string{"a.txt", "sub/c.txt"}, restored(RestoreOptions{Exclude: []string{"*.log", "cache"}}))
+	assert.Equal(t, []string{"sub/c.txt", "sub/cache/d.txt"}, restored(RestoreOptions{Include: []string{"/files/sub/*"}}))
+	assert.Equal(t, []string{"b.log"}, restored(RestoreOptions{Include: []string{"*.log"}, Prefixes: []string{"/files"}}))
+
+	p, err = New(b, Options{ReadOnly: true})
+	assert.Nil(t, err)
+	_, err = p.RestoreTree(context.Background(), RestoreOptions{Target: t.TempDir(), Prefixes: []string{"/nope"}})
+	assert.True(t, errors.Is(err, ErrNotInBackup))
+	_, err = p.RestoreTree(context.Background(), RestoreOptions{Target: t.TempDir(), Include: []string{"["}})
+	assert.NotNil(t, err)
+
+	// a corrupt file is counted, without stopping the others
+	h := sha1.Sum([]byte("a.txt"))
+	hash := fmt.Sprintf("%x", h)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "data", hash[:2], hash[2:4], hash), []byte("damaged"), 0600))
+	stats, err := p.RestoreTree(context.Background(), RestoreOptions{Target: t.TempDir()})
+	assert.Nil(t, err)
+	assert.Equal(t, RestoreStats{Files: 3, Bytes: int64(len("b.logsub/c.txtsub/cache/d.txt")), Failed: 1}, stats)
+	assert.Nil(t, p.Close())
+}
+
+func TestRestoreConflicts(t *testing.T) {
+	dir := t.TempDir()
+	b := NewMemoryBackend()
+	_, err := Init(b, 0, false)
+	assert.Nil(t, err)
+	backedUp := time.Unix(1600000000, 0)
+	for _, name := range []string{"same", "older", "newer", "missing"} {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, ioutil.WriteFile(path, []byte(name), 0600))
+		assert.Nil(t, os.Chtimes(path, backedUp, backedUp))
+	}
+	p, err := New(b, Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, p.AddDir(context.Background(), dir, "/f"))
+	assert.Nil(t, p.Close())
+
+	// the local "older" was modified before the backup, and "newer" after it
+	setup := func() string {
+		target := t.TempDir()
+		assert.Nil(t, os.MkdirAll(filepath.Join(target, "f"), 0755))
+		for name, modTime := range map[string]time.Time{"same": backedUp, "older": backedUp.Add(-time.Hour), "newer": backedUp.Add(time.Hour)} {
+			path := filepath.Join(target, "f", name)
+			data := name
+			if name != "same" {
+				data = "local " + name
+			}
+			assert.Nil(t, ioutil.WriteFile(path, []byte(data), 0600))
+			assert.Nil(t, os.Chtimes(path, modTime, modTime))
+		}
+		return target
+	}
+	read := func(target, name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(target, "f", name))
+		assert.Nil(t, err)
+		return string(data)
+	}
+	restore := func(target string, policy ConflictPolicy, dryRun bool) RestoreStats {
+		p, err := New(b, Options{ReadOnly: true})
+		assert.Nil(t, err)
+		stats, err := p.RestoreTree(context.Background(), RestoreOptions{Target: target, OnConflict: policy, DryRun: dryRun})
+		assert.Nil(t, err)
+		assert.Nil(t, p.Close())
+		return stats
+	}
+
+	target := setup()
+	stats := restore(target, ConflictOverwrite, true)
+	assert.Equal(t, RestoreStats{Files: 3, Bytes: int64(len("oldernewermissing")), Overwritten: 2, Unchanged: 1}, stats)
+	assert.Equal(t, "local older", read(target, "older"))
+	_, err = os.Stat(filepath.Join(target, "f", "missing"))
+	assert.True(t, os.IsNotExist(err))
+	stats = restore(target, ConflictAsk, true)
+	assert.Equal(t, 2, stats.Skipped)
+
+	stats = restore(target, ConflictSkip, false)
+	assert.Equal(t, RestoreStats{Files: 1, Bytes: int64(len("missing")), Unchanged: 1, Skipped: 2}, stats)
+	assert.Equal(t, "local older", read(target, "older"))
+	assert.Equal(t, "missing", read(target, "missing"))
+
+	stats = restore(target, ConflictIfNewer, false)
+	assert.Equal(t, RestoreStats{Files: 1, Bytes: int64(len("older")), Overwritten: 1, Unchanged: 2, Skipped: 1}, stats)
+	assert.Equal(t, "older", read(target, "older"))
+	assert.Equal(t, "local newer", read(target, "newer"))
+
+	stats = restore(target, ConflictKeepBoth, false)
+	assert.Equal(t, 1, stats.Files)
+	assert.Equal(t, "local newer", read(target, "newer"))
+	assert.Equal(t, "newer", read(target, "newer.restored"))
+	restore(target, ConflictKeepBoth, false)
+	assert.Equal(t, "newer", read(target, "newer.restored.2"))
+
+	stats = restore(target, ConflictOverwrite, false)
+	assert.Equal(t, 1, stats.Overwritten)
+	assert.Equal(t, "newer", read(target, "newer"))
+
+	// asking requires a terminal
+	p, err = New(b, Options{ReadOnly: true})
+	assert.Nil(t, err)
+	_, err = p.RestoreTree(context.Background(), RestoreOptions{Target: setup(), OnConflict: ConflictAsk})
+	assert.NotNil(t, err)
+	assert.Nil(t, p.Close())
+}
+
+func TestRestoreAtomic(t *testing.T) {
+	dir := t.TempDir()
+	b := NewMemoryBackend()
+	_, err := Init(b, 0, false)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("backed up"), 0600))
+	p, err := New(b, Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, p.AddFile(context.Background(), filepath.Join(dir, "a.txt"), "/a.txt"))
+	assert.Nil(t, p.Close())
+
+	target := t.TempDir()
+	localPath := filepath.Join(target, "a.txt")
+	assert.Nil(t, ioutil.WriteFile(localPath, []byte("original"), 0640))
+	restore := func() error {
+		p, err := New(b, Options{ReadOnly: true})
+		assert.Nil(t, err)
+		defer p.Close()
+		return p.Restore(context.Background(), "/a.txt", localPath)
+	}
+	files := func() []string {
+		infos, err := ioutil.ReadDir(target)
+		assert.Nil(t, err)
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		return names
+	}
+
+	// a write which fails part way (e.g. because the disk is full) leaves the original in place
+	orig := crashPoint
+	for _, step := range []string{"write ", "rename "} {
+		crashPoint = func(s string) error {
+			if strings.HasPrefix(s, step) {
+				return fmt.Errorf("no space left on device")
+			}
+			return nil
+		}
+		assert.NotNil(t, restore())
+		data, err := ioutil.ReadFile(localPath)
+		assert.Nil(t, err)
+		assert.Equal(t, "original", string(data))
+		assert.Equal(t, []string{"a.txt"}, files())
+	}
+	crashPoint = orig
+
+	assert.Nil(t, restore())
+	data, err := ioutil.ReadFile(localPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "backed up", string(data))
+	assert.Equal(t, []string{"a.txt"}, files())
+	info, err := os.Stat(localPath)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+}
+
+// writeProtectedBackend refuses every change, like a pack on a read-only mount
+type writeProtectedBackend struct {
+	Backend
+}
+
+func (b writeProtectedBackend) denied(name string) error {
+	return &os.PathError{Op: "write", Path: name, Err: syscall.EROFS}
+}
+
+func (b writeProtectedBackend) CreateObject() (ObjectWriter, error) { return nil, b.denied("object") }
+func (b writeProtectedBackend) DeleteObject(name string) error      { return b.denied(name) }
+func (b writeProtectedBackend) WriteFile(name string, data []byte) error {
+	return b.denied(name)
+}
+func (b writeProtectedBackend) CreateFile(name string, data []byte) error {
+	return b.denied(name)
+}
+func (b writeProtectedBackend) SwapFile(name string, old, data []byte) error {
+	return b.denied(name)
+}
+func (b writeProtectedBackend) RemoveFile(name string) error { return b.denied(name) }
+
+// lockDeniedBackend can't create lock files, e.g. because locks/ belongs to another user
+type lockDeniedBackend struct {
+	Backend
+}
+
+func (b lockDeniedBackend) CreateFile(name string, data []byte) error {
+	return &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+}
+
+func TestRestoreRedundantCopies(t *testing.T) {
+	dir := t.TempDir()
+	root := t.TempDir()
+	local := NewLocalBackend(root)
+	mirror := NewMemoryBackend()
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a.txt"), 0600))
+	for _, b := range []Backend{local, mirror} {
+		_, err := Init(b, 1, false)
+		assert.Nil(t, err)
+		p, err := New(b, Options{ParityBits: 1})
+		assert.Nil(t, err)
+		assert.Nil(t, p.AddFile(context.Background(), filepath.Join(dir, "a.txt"), "/a.txt"))
+		assert.Nil(t, p.Close())
+	}
+
+	// damage the refs and the object, leaving their bkups
+	pointer, err := ioutil.ReadFile(filepath.Join(root, refsFileName))
+	assert.Nil(t, err)
+	refsPath, err := getShaPath(root, strings.TrimSpace(string(pointer)), false)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(refsPath, []byte("damaged"), 0600))
+	const hash = "cfc7b4885384957ae445bc14914d4588f607651c"
+	objectPath := filepath.Join(root, "data", "cf", "c7", hash)
+	assert.Nil(t, ioutil.WriteFile(objectPath, []byte("damaged"), 0600))
+
+	localPath := filepath.Join(t.TempDir(), "a.txt")
+	restore := func(repairFrom ...Backend) error {
+		p, err := New(writeProtectedBackend{local}, Options{ReadOnly: true, ParityBits: 1, RepairFrom: repairFrom})
+		if err != nil {
+			return err
+		}
+		defer p.Close()
+		return p.Restore(context.Background(), "/a.txt", localPath)
+	}
+	assert.Nil(t, restore())
+	data, err := ioutil.ReadFile(localPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "a.txt", string(data))
+
+	// with the bkup damaged too, only the mirror has an intact copy
+	assert.Nil(t, os.Remove(localPath))
+	assert.Nil(t, ioutil.WriteFile(objectPath+bkupSuffix, []byte("damaged"), 0600))
+	err = restore()
+	assert.True(t, errors.Is(err, ErrCorruptObject), "got %v", err)
+	assert.NoFileExists(t, localPath)
+	assert.Nil(t, restore(mirror))
+	data, err = ioutil.ReadFile(localPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "a.txt", string(data))
+
+	// a permission error doesn't mean the pack is write-protected (a writer may be active), so it isn't read unlocked
+	_, err = New(lockDeniedBackend{local}, Options{ReadOnly: true, ParityBits: 1})
+	assert.True(t, errors.Is(err, os.ErrPermission), "got %v", err)
+
+	// nothing was repaired, as the pack is write-protected
+	data, err = ioutil.ReadFile(objectPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "damaged", string(data))
+	data, err = ioutil.ReadFile(refsPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "damaged", string(data))
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	root := t.TempDir()
+	b := NewLocalBackend(root)
+	_, err := Init(b, 1, false)
+	assert.Nil(t, err)
+	backup := func(name, contents string) {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600))
+		p, err := New(b, Options{ParityBits: 1})
+		assert.Nil(t, err)
+		assert.Nil(t, p.AddDir(context.Background(), dir, "/files"))
+		assert.Nil(t, p.Close())
+	}
+	backup("a.txt", "first")
+	entries, _, err := readReflog(b)
+	assert.Nil(t, err)
+	first := entries[0].sha1
+	backup("b.txt", "second")
+
+	p, err := OpenReadOnly(b)
+	assert.Nil(t, err)
+	read := func(r io.ReadCloser, err error) (string, error) {
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		return string(data), err
+	}
+	data, err := read(p.Open("/files/b.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "second", data)
+	data, err = read(p.OpenSnapshot(first[:8], "/files/a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "first", data)
+	_, err = read(p.OpenSnapshot(first[:8], "/files/b.txt"))
+	assert.True(t, errors.Is(err, ErrNotInBackup), "got %v", err)
+	const hash = "e0996a37c13d44c3b06074939d43fa3759bd32c1"
+	data, err = read(p.OpenObject(hash))
+	assert.Nil(t, err)
+	assert.Equal(t, "first", data)
+	_, err = read(p.Open("/files/c.txt"))
+	assert.True(t, errors.Is(err, ErrNotInBackup), "got %v", err)
+	_, err = read(p.OpenObject("not-a-hash"))
+	assert.NotNil(t, err)
+
+	// a corrupt object is read from its bkup instead
+	objPath, err := getShaPath(root, hash, false)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(objPath, []byte("fir5t"), 0600))
+	data, err = read(p.OpenObject(hash))
+	assert.Nil(t, err)
+	assert.Equal(t, "first", data)
+
+	// and then from a RepairFrom pack, and refused once no intact copy is left
+	assert.Nil(t, ioutil.WriteFile(objPath+".bkup", []byte("fir5t"), 0600))
+	_, err = read(p.OpenObject(hash))
+	assert.True(t, errors.Is(err, ErrCorruptObject), "got %v", err)
+	assert.Nil(t, p.Close())
+	mirror := NewMemoryBackend()
+	_, err = Init(mirror, 0, false)
+	assert.Nil(t, err)
+	assert.Nil(t, putObject(mirror, hash, []byte("first")))
+	p, err = New(b, Options{ParityBits: 1, ReadOnly: true, RepairFrom: []Backend{mirror}})
+	assert.Nil(t, err)
+	data, err = read(p.Open("/files/a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "first", data)
+
+	// an object which changes after it was verified is reported in place of EOF
+	r, err := p.Open("/files/b.txt")
+	if assert.Nil(t, err) {
+		v := r.(*verifyingReader)
+		assert.Nil(t, v.r.Close())
+		v.r = ioutil.NopCloser(strings.NewReader("chang"))
+		data, err := ioutil.ReadAll(r)
+		assert.True(t, errors.Is(err, ErrCorruptObject), "got %v", err)
+		assert.Equal(t, "chang", string(data))
+		assert.Nil(t, r.Close())
+	}
+	assert.Nil(t, p.Close())
+}
+
+func TestRestoreTreeUnsafePaths(t *testing.T) {
+	// a ref whose path leads outside of the target dir makes the refs unusable
+	b := NewMemoryBackend()
+	_, err := Init(b, 0, false)
+	assert.Nil(t, err)
+	p, err := New(b, Options{})
+	assert.Nil(t, err)
+	pi := p.(*packImp)
+	pi.refs = append(pi.refs, &refEntry{path: "/../../escape.txt", sha1: "cfc7b4885384957ae445bc14914d4588f607651c", size: 5})
+	assert.Nil(t, p.Close())
+	_, err = New(b, Options{ReadOnly: true})
+	assert.NotNil(t, err)
+	assert.Contains(t, fmt.Sprint(err), "isn't clean")
+	_, err = restoreLocalPath(t.TempDir(), "../escape.txt")
+	assert.NotNil(t, err)
+
+	// nor through a symlink which was already under the target
+	outside := t.TempDir()
+	target := t.TempDir()
+	assert.Nil(t, os.Symlink(outside, filepath.Join(target, "a")))
+	_, err = restoreLocalPath(target, "/a/x/passwd")
+	assert.NotNil(t, err)
+	assert.Contains(t, fmt.Sprint(err), "symlink")
+	localPath, err := restoreLocalPath(target, "/b/x/passwd")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(target, "b", "x", "passwd"), localPath)
+
+	// nothing is written through a symlink which was restored earlier in the same run
+	outside = t.TempDir()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	assert.Nil(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "a/x", Linkname: outside, Mode: 0777}))
+	assert.Nil(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "a/x/passwd", Mode: 0600, Size: 5}))
+	_, err = tw.Write([]byte("owned"))
+	assert.Nil(t, err)
+	assert.Nil(t, tw.Close())
+	b = NewMemoryBackend()
+	_, err = Init(b, 0, false)
+	assert.Nil(t, err)
+	_, err = ImportTar(context.Background(), b, &buf, ImportOptions{Alias: "/"})
+	assert.Nil(t, err)
+
+	target = t.TempDir()
+	p, err = New(b, Options{ReadOnly: true})
+	assert.Nil(t, err)
+	stats, err := p.RestoreTree(context.Background(), RestoreOptions{Target: target})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Files)
+	assert.Equal(t, 1, stats.Failed)
+	assert.Nil(t, p.Close())
+	link, err := os.Readlink(filepath.Join(target, "a", "x"))
+	assert.Nil(t, err)
+	assert.Equal(t, outside, link)
+	assert.NoFileExists(t, filepath.Join(outside, "passwd"))
+}
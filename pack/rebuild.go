@@ -0,0 +1,236 @@
+package pack
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// lostAndFoundPrefix is the alias under which RebuildIndex records objects that aren't referenced by any refs
+const lostAndFoundPrefix = "/lost+found/"
+
+// scannedObject is an object found while scanning data/
+type scannedObject struct {
+	sha1    string
+	name    string // a copy of the object (the object, its bkup, or a repair copy) whose contents match sha1
+	modTime time.Time
+}
+
+// RebuildIndex reconstructs the refs and reflog of a pack by scanning every object under data/.
+// Objects which look like refs are validated and become the snapshot chain (ordered by modification time);
+// all objects which aren't referenced by any refs are recorded under /lost+found/<sha1> in a new snapshot.
+// It returns the number of snapshots and orphaned objects which were found; cancelling ctx stops the scan
+// before anything is written.
+func RebuildIndex(ctx context.Context, b Backend, parityBits int) (int, int, error) {
+	lock, err := acquireLock(b, lockExclusive)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer lock.Release()
+
+	meta, err := readMeta(b)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return 0, 0, err
+		}
+		fmt.Fprintf(os.Stderr, "WARNING: %s/%s is missing; creating a new one\n", b, metaFileName)
+		meta, err = newPackMeta(parityBits)
+		if err != nil {
+			return 0, 0, err
+		}
+		err = writeMeta(b, meta)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	err = checkMeta(meta, parityBits)
+	if err != nil {
+		return 0, 0, err
+	}
+	if meta.appendOnly {
+		b = newAppendOnlyBackend(b)
+	}
+
+	objects, err := scanObjects(ctx, b)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var snapshots []*scannedObject
+	var latestRefs []*refEntry
+	referenced := map[string]bool{}
+	for _, obj := range objects {
+		refs, ok := readRefsCandidate(b, obj.name)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "found refs %s (%d entries, %s)\n", obj.sha1, len(refs), obj.modTime.Format(time.RFC3339))
+		snapshots = append(snapshots, obj)
+		referenced[obj.sha1] = true
+		for _, ref := range refs {
+			referenced[ref.sha1] = true
+		}
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].modTime.Before(snapshots[j].modTime)
+	})
+
+	var entries []reflogEntry
+	for _, obj := range snapshots {
+		entries = append(entries, reflogEntry{sha1: obj.sha1, time: obj.modTime})
+	}
+	err = rewriteReflog(b, entries)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	head := ""
+	if len(snapshots) > 0 {
+		last := snapshots[len(snapshots)-1]
+		head = last.sha1
+		latestRefs, _ = readRefsCandidate(b, last.name)
+	}
+	pointer, err := b.ReadFile(refsFileName)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return 0, 0, err
+		}
+		pointer = nil
+	}
+
+	p := &packImp{
+		backend:    b,
+		refs:       latestRefs,
+		refIndex:   buildRefIndex(latestRefs),
+		parityBits: parityBits,
+		meta:       meta,
+		head:       head,
+		pointer:    pointer,
+	}
+
+	numOrphans := 0
+	for _, obj := range objects {
+		if referenced[obj.sha1] {
+			continue
+		}
+		numOrphans++
+		fmt.Fprintf(os.Stderr, "found orphaned object %s\n", obj.sha1)
+		err = p.addMeta(lostAndFoundPrefix+obj.sha1, obj.sha1, -1, -1)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if head == "" || numOrphans > 0 {
+		err = p.writeRefs(p.refs, false)
+	} else {
+		err = p.writeRefsPointer(head)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(snapshots), numOrphans, nil
+}
+
+// scanObjects returns every object which has at least one copy (the object, its .bkup, or a repair copy) whose
+// contents match its name; objects without a valid copy are reported and skipped
+func scanObjects(ctx context.Context, b Backend) ([]*scannedObject, error) {
+	infos, err := b.ListObjects()
+	if err != nil {
+		return nil, err
+	}
+	copies := map[string][]Info{}
+	for _, info := range infos {
+		sha1, ok := objectNameSha1(info.Name)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "ignoring unexpected object %s\n", b.ObjectLocation(info.Name))
+			continue
+		}
+		copies[sha1] = append(copies[sha1], info)
+	}
+
+	var objects []*scannedObject
+	for sha1, infos := range copies {
+		// prefer the primary copy over the .bkup (and any repair copies)
+		sort.Slice(infos, func(i, j int) bool {
+			return infos[i].Name < infos[j].Name
+		})
+		var found *scannedObject
+		for _, info := range infos {
+			err := ctx.Err()
+			if err != nil {
+				return nil, err
+			}
+			actualSha1, err := hashObject(b, info.Name)
+			if err != nil {
+				return nil, err
+			}
+			if actualSha1 != sha1 {
+				fmt.Fprintf(os.Stderr, "WARNING: %s is corrupt\n", b.ObjectLocation(info.Name))
+				continue
+			}
+			found = &scannedObject{sha1: sha1, name: info.Name, modTime: info.ModTime}
+			break
+		}
+		if found == nil {
+			fmt.Fprintf(os.Stderr, "ERROR: no valid copy of %s exists\n", sha1)
+			continue
+		}
+		objects = append(objects, found)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].sha1 < objects[j].sha1
+	})
+	return objects, nil
+}
+
+func isSha1(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// readRefsCandidate parses the named object as refs, returning false as soon as a line doesn't look like a refs entry
+func readRefsCandidate(b Backend, name string) ([]*refEntry, bool) {
+	file, err := b.GetObject(name)
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+
+	var refs []*refEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !isSha1(fields[1]) {
+			return nil, false
+		}
+		aliasPath, err := decodePath(fields[0])
+		if err != nil || !strings.HasPrefix(aliasPath, "/") {
+			return nil, false
+		}
+		size, modTime, mode, err := parseRefStat(fields[2:])
+		if err != nil {
+			return nil, false
+		}
+		refs = append(refs, &refEntry{
+			path:    aliasPath,
+			sha1:    fields[1],
+			size:    size,
+			modTime: modTime,
+			mode:    mode,
+		})
+	}
+	if scanner.Err() != nil || len(refs) == 0 {
+		return nil, false
+	}
+	return refs, true
+}
@@ -0,0 +1,250 @@
+package pack
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reflogCopies lists the files which each hold a full copy of the reflog; every pointer update is recorded in all of them
+var reflogCopies = []string{"refs.log", "refs.log.bkup"}
+
+const reflogPartialFlag = "partial"
+
+// reflogEntry records an update of the refs pointer
+type reflogEntry struct {
+	sha1 string
+	time time.Time
+
+	// partial is set for checkpoints written while a backup was still in progress
+	partial bool
+}
+
+func (e reflogEntry) String() string {
+	record := fmt.Sprintf("%s %d", e.sha1, e.time.Unix())
+	if e.partial {
+		record += " " + reflogPartialFlag
+	}
+	return fmt.Sprintf("%s %08x\n", record, crc32.ChecksumIEEE([]byte(record)))
+}
+
+// parseReflog returns all valid entries in data, along with the number of lines which failed their checksum
+func parseReflog(data []byte) ([]reflogEntry, int) {
+	var entries []reflogEntry
+	numInvalid := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		e, ok := parseReflogLine(line)
+		if !ok {
+			numInvalid++
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, numInvalid
+}
+
+func parseReflogLine(line string) (reflogEntry, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || len(fields) > 4 || len(fields[0]) != 40 {
+		return reflogEntry{}, false
+	}
+	checksum := fields[len(fields)-1]
+	record := strings.Join(fields[:len(fields)-1], " ")
+	if fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(record))) != checksum {
+		return reflogEntry{}, false
+	}
+	ts, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return reflogEntry{}, false
+	}
+	partial := false
+	if len(fields) == 4 {
+		if fields[2] != reflogPartialFlag {
+			return reflogEntry{}, false
+		}
+		partial = true
+	}
+	return reflogEntry{
+		sha1:    fields[0],
+		time:    time.Unix(ts, 0),
+		partial: partial,
+	}, true
+}
+
+// readReflog merges the valid entries of all reflog copies (oldest first); damaged is true if any copy is
+// missing entries or contains invalid records
+func readReflog(b Backend) (entries []reflogEntry, damaged bool, err error) {
+	seen := map[reflogEntry]bool{}
+	var perCopy []int
+	for _, name := range reflogCopies {
+		data, err := b.ReadFile(name)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return nil, false, err
+			}
+		}
+		copyEntries, numInvalid := parseReflog(data)
+		if numInvalid > 0 {
+			damaged = true
+		}
+		copySeen := map[reflogEntry]bool{}
+		for _, e := range copyEntries {
+			copySeen[e] = true
+			if !seen[e] {
+				seen[e] = true
+				entries = append(entries, e)
+			}
+		}
+		perCopy = append(perCopy, len(copySeen))
+	}
+	for _, n := range perCopy {
+		if n != len(entries) {
+			damaged = true
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].time.Before(entries[j].time)
+	})
+	return entries, damaged, nil
+}
+
+// isPartialHead returns true if the newest reflog entry for head was written by a checkpoint
+func isPartialHead(b Backend, head string) (bool, error) {
+	if head == "" {
+		return false, nil
+	}
+	entries, _, err := readReflog(b)
+	if err != nil {
+		return false, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].sha1 == head {
+			return entries[i].partial, nil
+		}
+	}
+	return false, nil
+}
+
+func isReflogCopy(name string) bool {
+	for _, copyName := range reflogCopies {
+		if name == copyName {
+			return true
+		}
+	}
+	return false
+}
+
+func reflogContains(entries []reflogEntry, sha1 string) bool {
+	for _, e := range entries {
+		if e.sha1 == sha1 {
+			return true
+		}
+	}
+	return false
+}
+
+// findSnapshot returns the index of the newest entry whose sha1 starts with id, which must not match the sha1 of any
+// other snapshot
+func findSnapshot(entries []reflogEntry, id string) (int, error) {
+	found := -1
+	for i, e := range entries {
+		if !strings.HasPrefix(e.sha1, id) {
+			continue
+		}
+		if found >= 0 && entries[found].sha1 != e.sha1 {
+			return -1, fmt.Errorf("snapshot id %s is ambiguous; it matches %s and %s", id, entries[found].sha1, e.sha1)
+		}
+		found = i
+	}
+	if id == "" || found < 0 {
+		return -1, fmt.Errorf("snapshot %q: %w", id, ErrUnknownSnapshot)
+	}
+	return found, nil
+}
+
+// containsSnapshot reports whether entries record the snapshot with the given sha1, whenever that was
+func containsSnapshot(entries []reflogEntry, sha1 string) bool {
+	for _, e := range entries {
+		if e.sha1 == sha1 {
+			return true
+		}
+	}
+	return false
+}
+
+func containsReflogEntry(entries []reflogEntry, e reflogEntry) bool {
+	for _, other := range entries {
+		if other.sha1 == e.sha1 && other.time.Unix() == e.time.Unix() && other.partial == e.partial {
+			return true
+		}
+	}
+	return false
+}
+
+// appendReflog records a pointer update in every reflog copy; each copy is rewritten (rather than appended to) so
+// that a crash can't leave a torn record behind
+func appendReflog(b Backend, e reflogEntry) error {
+	entries, _, err := readReflog(b)
+	if err != nil {
+		return err
+	}
+	if !containsReflogEntry(entries, e) {
+		entries = append(entries, e)
+	}
+	return writeReflog(b, entries)
+}
+
+// rewriteReflog replaces every reflog copy with the given entries
+func rewriteReflog(b Backend, entries []reflogEntry) error {
+	fmt.Fprintf(os.Stderr, "rewriting reflog of %s\n", b)
+	return writeReflog(b, entries)
+}
+
+func writeReflog(b Backend, entries []reflogEntry) error {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		buf.WriteString(e.String())
+	}
+	for _, name := range reflogCopies {
+		err := b.WriteFile(name, buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadRefsFromReflog returns the refs of the newest reflog entry which can be read without error
+func loadRefsFromReflog(b Backend, readOnly bool) (string, []*refEntry, error) {
+	entries, _, err := readReflog(b)
+	if err != nil {
+		return "", nil, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		refs, err := readRefs(b, e.sha1, readOnly)
+		if err != nil && readOnly {
+			// a read-only pack can't restore its refs from their bkup, but it can read the bkup
+			intactRefs, intactErr := readSnapshotRefs(b, e.sha1)
+			if intactErr == nil {
+				refs, err = intactRefs, nil
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "skipping reflog entry %s from %s: %s\n", e.sha1, e.time.Format(time.RFC3339), err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "using refs %s from %s\n", e.sha1, e.time.Format(time.RFC3339))
+		return e.sha1, refs, nil
+	}
+	return "", nil, fmt.Errorf("no valid reflog entries found")
+}
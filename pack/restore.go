@@ -0,0 +1,366 @@
+package pack
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alexcb/acbup/util/promptutil"
+)
+
+// ConflictPolicy decides what RestoreTree does with a file which already exists, and differs from the backed up one
+// (a file which matches it is always left alone)
+type ConflictPolicy int
+
+const (
+	// ConflictOverwrite replaces the existing file
+	ConflictOverwrite ConflictPolicy = iota
+	// ConflictSkip leaves the existing file alone
+	ConflictSkip
+	// ConflictKeepBoth restores the backed up file alongside the existing one, as <path>.restored (or
+	// <path>.restored.2, ...)
+	ConflictKeepBoth
+	// ConflictIfNewer replaces the existing file only if the backed up one was modified more recently
+	ConflictIfNewer
+	// ConflictAsk prompts for each file; it requires an interactive pack
+	ConflictAsk
+)
+
+var conflictPolicyNames = map[ConflictPolicy]string{
+	ConflictOverwrite: "overwrite",
+	ConflictSkip:      "skip",
+	ConflictKeepBoth:  "keep-both",
+	ConflictIfNewer:   "if-newer",
+	ConflictAsk:       "ask",
+}
+
+func (c ConflictPolicy) String() string {
+	return conflictPolicyNames[c]
+}
+
+// ParseConflictPolicy parses the name of a ConflictPolicy (e.g. "keep-both")
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	for c, name := range conflictPolicyNames {
+		if name == s {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown conflict policy %q; must be one of overwrite, skip, keep-both, if-newer, or ask", s)
+}
+
+// restoreAction is what RestoreTree does (or, in a dry run, would do) with a file
+type restoreAction string
+
+const (
+	restoreCreate    restoreAction = "create"
+	restoreOverwrite restoreAction = "overwrite"
+	restoreKeepBoth  restoreAction = "keep both copies of"
+	restoreSkip      restoreAction = "leave alone"
+	restoreUnchanged restoreAction = "leave unchanged"
+	restoreAsk       restoreAction = "ask about"
+)
+
+// done describes the action once it has been taken
+func (a restoreAction) done() string {
+	switch a {
+	case restoreCreate:
+		return "restored"
+	case restoreOverwrite:
+		return "overwritten"
+	case restoreKeepBoth:
+		return "restored alongside the existing file"
+	case restoreUnchanged:
+		return "already matches"
+	}
+	return "left alone"
+}
+
+// RestoreOptions select which files RestoreTree restores, and where to
+type RestoreOptions struct {
+	// Snapshot is the id (or a unique prefix of it) of the snapshot to restore from; the current one is used if it's
+	// empty
+	Snapshot string
+
+	// Target is the dir which files are restored under; a file recorded as /a/b is restored to <Target>/a/b
+	Target string
+
+	// Prefixes limits the restore to the files or dirs at these paths (all files are restored if it's empty)
+	Prefixes []string
+
+	// Include limits the restore to files matching at least one of these globs, and Exclude skips files matching any
+	// of them; see matchGlob
+	Include []string
+	Exclude []string
+
+	// OnConflict decides what happens to files which already exist
+	OnConflict ConflictPolicy
+
+	// DryRun only reports what would be restored; existing files are hashed to find those which already match
+	DryRun bool
+}
+
+// RestoreStats summarizes what RestoreTree restored (or, in a dry run, would restore)
+type RestoreStats struct {
+	// Files and Bytes count the files which were written, of which Overwritten replaced an existing file
+	Files       int
+	Bytes       int64
+	Overwritten int
+
+	// Unchanged counts the existing files which already matched, and Skipped those which were left alone because of
+	// OnConflict
+	Unchanged int
+	Skipped   int
+
+	// Failed counts the files which couldn't be restored (e.g. because no intact copy exists)
+	Failed int
+}
+
+// RestoreTree restores every file of a snapshot which matches opts under opts.Target, verifying each object first. A
+// file which can't be restored is reported and counted, without stopping the others; it returns ctx's error (and
+// the counts so far) once ctx is done.
+func (p *packImp) RestoreTree(ctx context.Context, opts RestoreOptions) (RestoreStats, error) {
+	var stats RestoreStats
+	if opts.Target == "" {
+		return stats, fmt.Errorf("no target dir was given")
+	}
+	if opts.OnConflict == ConflictAsk && !opts.DryRun && !p.interactive {
+		return stats, fmt.Errorf("unable to ask about conflicting files in non-interactive mode")
+	}
+	for _, pattern := range append(append([]string{}, opts.Include...), opts.Exclude...) {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return stats, fmt.Errorf("invalid glob %q: %w", pattern, err)
+		}
+	}
+	refs, err := p.snapshotRefs(opts.Snapshot)
+	if err != nil {
+		return stats, err
+	}
+
+	index := buildRefIndex(refs)
+	var paths []string
+	for p := range index {
+		if restoreSelected(p, opts) {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		return stats, fmt.Errorf("no files match: %w", ErrNotInBackup)
+	}
+	sort.Strings(paths)
+
+	for _, aliasPath := range paths {
+		err := ctx.Err()
+		if err != nil {
+			return stats, err
+		}
+		ref := index[aliasPath]
+		var action restoreAction
+		localPath, err := restoreLocalPath(opts.Target, aliasPath)
+		if err == nil {
+			action, localPath, err = p.planRestore(ref, localPath, opts)
+		}
+		if err == nil && !opts.DryRun {
+			switch action {
+			case restoreCreate, restoreOverwrite, restoreKeepBoth:
+				err = os.MkdirAll(filepath.Dir(localPath), 0700)
+				if err == nil {
+					err = p.restoreRef(ref, localPath)
+				}
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: failed to restore %s: %s\n", aliasPath, err)
+			stats.Failed++
+			continue
+		}
+
+		if opts.DryRun {
+			fmt.Fprintf(os.Stderr, "would %s %s\n", action, localPath)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s -> %s: %s\n", aliasPath, localPath, action.done())
+		}
+		switch action {
+		case restoreUnchanged:
+			stats.Unchanged++
+		case restoreSkip, restoreAsk:
+			stats.Skipped++
+		default:
+			stats.Files++
+			if ref.size > 0 {
+				stats.Bytes += ref.size
+			}
+			if action == restoreOverwrite {
+				stats.Overwritten++
+			}
+		}
+	}
+	return stats, nil
+}
+
+// restoreLocalPath returns the path under target which the file at aliasPath is restored to. It refuses a path which
+// would lead outside of target, or through a symlink under target (whether it was just restored or was already
+// there), as that could point anywhere.
+func restoreLocalPath(target, aliasPath string) (string, error) {
+	target = filepath.Clean(target)
+	localPath := filepath.Join(target, filepath.FromSlash(aliasPath))
+	rel, err := filepath.Rel(target, localPath)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s would be restored outside of %s", aliasPath, target)
+	}
+	dir := target
+	components := strings.Split(rel, string(filepath.Separator))
+	for _, component := range components[:len(components)-1] {
+		dir = filepath.Join(dir, component)
+		info, err := os.Lstat(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			// nothing below it exists yet, so it's created as a plain dir
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to restore %s through %s, which is a symlink", aliasPath, dir)
+		}
+	}
+	return localPath, nil
+}
+
+// planRestore decides what to do with the file which ref records, given that it's restored to localPath; it returns
+// the path to restore it to, which differs from localPath when both copies are kept
+func (p *packImp) planRestore(ref *refEntry, localPath string, opts RestoreOptions) (restoreAction, string, error) {
+	info, err := os.Lstat(localPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return restoreCreate, localPath, nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	same, err := localMatches(ref, localPath, info)
+	if err != nil {
+		return "", "", err
+	}
+	if same {
+		return restoreUnchanged, localPath, nil
+	}
+
+	policy := opts.OnConflict
+	if policy == ConflictAsk {
+		if opts.DryRun {
+			return restoreAsk, localPath, nil
+		}
+		choice, err := promptutil.Prompt(fmt.Sprintf("%s differs from the backed up copy; overwrite it, skip it, or keep both? [o/s/b] ", localPath), []string{"o", "s", "b"}, -1, true)
+		if err != nil {
+			return "", "", err
+		}
+		policy = map[string]ConflictPolicy{"o": ConflictOverwrite, "s": ConflictSkip, "b": ConflictKeepBoth}[choice]
+	}
+	switch policy {
+	case ConflictSkip:
+		return restoreSkip, localPath, nil
+	case ConflictKeepBoth:
+		for n := 1; ; n++ {
+			name := localPath + ".restored"
+			if n > 1 {
+				name = fmt.Sprintf("%s.%d", name, n)
+			}
+			_, err := os.Lstat(name)
+			if errors.Is(err, os.ErrNotExist) {
+				return restoreKeepBoth, name, nil
+			}
+			if err != nil {
+				return "", "", err
+			}
+		}
+	case ConflictIfNewer:
+		if ref.size < 0 || ref.modTime <= info.ModTime().UnixNano() {
+			return restoreSkip, localPath, nil
+		}
+	}
+	return restoreOverwrite, localPath, nil
+}
+
+// localMatches returns true if the existing file at localPath holds what ref records
+func localMatches(ref *refEntry, localPath string, info os.FileInfo) (bool, error) {
+	if ref.isSymlink() {
+		if info.Mode()&os.ModeSymlink == 0 {
+			return false, nil
+		}
+		target, err := os.Readlink(localPath)
+		if err != nil {
+			return false, err
+		}
+		return fmt.Sprintf("%x", sha1.Sum([]byte(target))) == ref.sha1, nil
+	}
+	if !info.Mode().IsRegular() || (ref.size >= 0 && info.Size() != ref.size) {
+		return false, nil
+	}
+	hash, err := getSha1(localPath)
+	if err != nil {
+		return false, err
+	}
+	return hash == ref.sha1, nil
+}
+
+// restoreSelected returns true if the file at p is selected by the prefixes and globs of opts
+func restoreSelected(p string, opts RestoreOptions) bool {
+	if len(opts.Prefixes) > 0 {
+		ok := false
+		for _, prefix := range opts.Prefixes {
+			prefix = path.Clean("/" + prefix)
+			if prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(opts.Include) > 0 {
+		ok := false
+		for _, pattern := range opts.Include {
+			if matchGlob(pattern, p) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	for _, pattern := range opts.Exclude {
+		if matchGlob(pattern, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchGlob matches a glob (in the syntax of path.Match) against the file at p. A glob without a slash (e.g. *.log)
+// matches any component of the path, while one with a slash (e.g. /home/*/.cache) is matched against the whole path;
+// either way, a glob which matches a dir matches everything in it.
+func matchGlob(pattern, p string) bool {
+	if !strings.Contains(pattern, "/") {
+		for _, component := range strings.Split(strings.TrimPrefix(p, "/"), "/") {
+			if ok, _ := path.Match(pattern, component); ok {
+				return true
+			}
+		}
+		return false
+	}
+	pattern = path.Clean("/" + pattern)
+	for ; p != "/"; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
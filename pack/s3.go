@@ -0,0 +1,612 @@
+package pack
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config describes where (and as whom) an S3Backend stores a pack
+type S3Config struct {
+	Bucket string
+	// Prefix is prepended to every key, e.g. "backups/laptop"
+	Prefix string
+	Region string
+	// Endpoint is the URL of an S3-compatible service (e.g. "http://localhost:9000" for MinIO); when set, buckets
+	// are addressed by path rather than by host name. It defaults to AWS.
+	Endpoint string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// PartSize is the size of each part of a multipart upload; objects no larger than this are uploaded in one
+	// request. It defaults to 16MiB (and must be at least 5MiB).
+	PartSize int64
+
+	Client *http.Client
+}
+
+const defaultS3PartSize = 16 * 1024 * 1024
+
+// s3Backend stores a pack in an S3 bucket; objects are stored under <prefix>/data/xx/yy/<name>
+type s3Backend struct {
+	cfg       S3Config
+	endpoint  *url.URL
+	pathStyle bool
+	prefix    string
+}
+
+// NewS3Backend returns a backend which stores a pack in an S3 (or S3-compatible) bucket
+func NewS3Backend(cfg S3Config) (Backend, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("no s3 bucket was given")
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, fmt.Errorf("no s3 credentials were given; set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = defaultS3PartSize
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	b := &s3Backend{cfg: cfg}
+	if cfg.Endpoint == "" {
+		b.endpoint = &url.URL{Scheme: "https", Host: fmt.Sprintf("s3.%s.amazonaws.com", cfg.Region)}
+	} else {
+		u, err := url.Parse(cfg.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("bad s3 endpoint %s: %w", cfg.Endpoint, err)
+		}
+		b.endpoint = u
+		b.pathStyle = true
+	}
+	b.prefix = strings.Trim(cfg.Prefix, "/")
+	if b.prefix != "" {
+		b.prefix += "/"
+	}
+	return b, nil
+}
+
+// newS3BackendFromURL parses dst (s3://bucket/prefix) and takes the remaining settings from the environment
+// variables used by the AWS tools
+func newS3BackendFromURL(dst string) (Backend, error) {
+	u, err := url.Parse(dst)
+	if err != nil {
+		return nil, err
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_S3")
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	return NewS3Backend(S3Config{
+		Bucket:          u.Host,
+		Prefix:          u.Path,
+		Region:          region,
+		Endpoint:        endpoint,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	})
+}
+
+func (b *s3Backend) String() string {
+	return "s3://" + b.cfg.Bucket + "/" + strings.TrimSuffix(b.prefix, "/")
+}
+
+func (b *s3Backend) objectKey(name string) (string, error) {
+	if len(name) < 40 || !isSha1(name[:40]) {
+		return "", fmt.Errorf("invalid object name %q", name)
+	}
+	return b.prefix + "data/" + name[0:2] + "/" + name[2:4] + "/" + name, nil
+}
+
+func (b *s3Backend) ObjectLocation(name string) string {
+	key, err := b.objectKey(name)
+	if err != nil {
+		return name
+	}
+	return "s3://" + b.cfg.Bucket + "/" + key
+}
+
+// s3Error is an error response from S3
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+	method     string
+	key        string
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3 %s %s failed with status %d", e.method, e.key, e.StatusCode)
+	}
+	return fmt.Sprintf("s3 %s %s failed with status %d: %s: %s", e.method, e.key, e.StatusCode, e.Code, e.Message)
+}
+
+func (e *s3Error) Is(target error) bool {
+	return target == os.ErrNotExist && e.StatusCode == http.StatusNotFound
+}
+
+// isPreconditionFailed returns true if a conditional request failed because its condition didn't hold
+func isPreconditionFailed(err error) bool {
+	var se *s3Error
+	if !errors.As(err, &se) {
+		return false
+	}
+	// S3 returns 409 when a conditional write races with another write of the same key
+	return se.StatusCode == http.StatusPreconditionFailed || se.StatusCode == http.StatusConflict
+}
+
+// do sends a signed request; responses other than 2xx are returned as an *s3Error, and the caller must close the
+// body of successful responses
+func (b *s3Backend) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	host := b.endpoint.Host
+	path := strings.TrimSuffix(b.endpoint.Path, "/") + "/"
+	if b.pathStyle {
+		path += b.cfg.Bucket + "/"
+	} else {
+		host = b.cfg.Bucket + "." + host
+	}
+	path = s3EncodePath(path + key)
+	rawQuery := s3CanonicalQuery(query)
+	rawURL := b.endpoint.Scheme + "://" + host + path
+	if rawQuery != "" {
+		rawURL += "?" + rawQuery
+	}
+
+	req, err := http.NewRequest(method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if b.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", b.cfg.SessionToken)
+	}
+	sum := sha256.Sum256(body)
+	s3Sign(req, host, path, rawQuery, hex.EncodeToString(sum[:]), b.cfg.AccessKeyID, b.cfg.SecretAccessKey, b.cfg.Region, time.Now())
+
+	resp, err := b.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		e := &s3Error{StatusCode: resp.StatusCode, method: method, key: key}
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		xml.Unmarshal(data, e)
+		return nil, e
+	}
+	return resp, nil
+}
+
+// doXML sends a request and decodes its (XML) response into v; S3 can report errors in the body of a 200 response
+// to some requests, such as completing a multipart upload
+func (b *s3Backend) doXML(method, key string, query url.Values, header http.Header, body []byte, v interface{}) error {
+	resp, err := b.do(method, key, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		e := &s3Error{StatusCode: resp.StatusCode, method: method, key: key}
+		xml.Unmarshal(data, e)
+		return e
+	}
+	if v == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, v)
+}
+
+func (b *s3Backend) get(key string) ([]byte, string, error) {
+	resp, err := b.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, resp.Header.Get("ETag"), nil
+}
+
+func (b *s3Backend) head(name, key string) (Info, error) {
+	resp, err := b.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+	info := Info{Name: name, Size: resp.ContentLength}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return info, nil
+}
+
+func (b *s3Backend) put(key string, data []byte, header http.Header) error {
+	resp, err := b.do(http.MethodPut, key, nil, header, data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b *s3Backend) delete(key string) error {
+	resp, err := b.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string `xml:"Key"`
+		Size         int64  `xml:"Size"`
+		LastModified string `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+// list returns every key which starts with prefix; when delimiter is set, keys which continue past the next
+// delimiter are left out
+func (b *s3Backend) list(prefix, delimiter string) ([]Info, error) {
+	var infos []Info
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		var result s3ListResult
+		err := b.doXML(http.MethodGet, "", query, nil, nil, &result)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			modTime, _ := time.Parse(time.RFC3339, c.LastModified)
+			infos = append(infos, Info{Name: c.Key, Size: c.Size, ModTime: modTime})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return infos, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// s3ObjectWriter spools an object to a local temporary file, since it can only be uploaded once its name is known
+type s3ObjectWriter struct {
+	f *os.File
+	b *s3Backend
+}
+
+func (b *s3Backend) CreateObject() (ObjectWriter, error) {
+	f, err := ioutil.TempFile("", "acbup-s3-")
+	if err != nil {
+		return nil, err
+	}
+	return &s3ObjectWriter{f: f, b: b}, nil
+}
+
+func (w *s3ObjectWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+func (w *s3ObjectWriter) Commit(name string) error {
+	defer w.Abort()
+	key, err := w.b.objectKey(name)
+	if err != nil {
+		return err
+	}
+	size, err := w.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	_, err = w.f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	if size <= w.b.cfg.PartSize {
+		data, err := ioutil.ReadAll(w.f)
+		if err != nil {
+			return err
+		}
+		return w.b.put(key, data, nil)
+	}
+	return w.b.putMultipart(key, w.f)
+}
+
+func (w *s3ObjectWriter) Abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// putMultipart uploads r in parts of PartSize, so that large objects never need to be held in memory
+func (b *s3Backend) putMultipart(key string, r io.Reader) error {
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err := b.doXML(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, &initiated)
+	if err != nil {
+		return err
+	}
+
+	err = b.uploadParts(key, initiated.UploadID, r)
+	if err != nil {
+		resp, abortErr := b.do(http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil)
+		if abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+func (b *s3Backend) uploadParts(key, uploadID string, r io.Reader) error {
+	var complete struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}
+	buf := make([]byte, b.cfg.PartSize)
+	for partNumber := 1; ; partNumber++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+		resp, err := b.do(http.MethodPut, key, query, nil, buf[:n])
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, s3CompletedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	return b.doXML(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body, nil)
+}
+
+func (b *s3Backend) GetObject(name string) (io.ReadCloser, error) {
+	key, err := b.objectKey(name)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b *s3Backend) StatObject(name string) (Info, error) {
+	key, err := b.objectKey(name)
+	if err != nil {
+		return Info{}, err
+	}
+	return b.head(name, key)
+}
+
+func (b *s3Backend) ListObjects() ([]Info, error) {
+	infos, err := b.list(b.prefix+"data/", "")
+	if err != nil {
+		return nil, err
+	}
+	var objects []Info
+	for _, info := range infos {
+		name := info.Name[strings.LastIndex(info.Name, "/")+1:]
+		if key, err := b.objectKey(name); err != nil || key != info.Name {
+			fmt.Fprintf(os.Stderr, "ignoring unexpected key %s\n", info.Name)
+			continue
+		}
+		info.Name = name
+		objects = append(objects, info)
+	}
+	return objects, nil
+}
+
+func (b *s3Backend) DeleteObject(name string) error {
+	key, err := b.objectKey(name)
+	if err != nil {
+		return err
+	}
+	return b.delete(key)
+}
+
+func (b *s3Backend) ReadFile(name string) ([]byte, error) {
+	data, _, err := b.get(b.prefix + name)
+	return data, err
+}
+
+func (b *s3Backend) StatFile(name string) (Info, error) {
+	return b.head(name, b.prefix+name)
+}
+
+func (b *s3Backend) WriteFile(name string, data []byte) error {
+	return b.put(b.prefix+name, data, nil)
+}
+
+func (b *s3Backend) CreateFile(name string, data []byte) error {
+	err := b.put(b.prefix+name, data, http.Header{"If-None-Match": {"*"}})
+	if isPreconditionFailed(err) {
+		return &os.PathError{Op: "create", Path: name, Err: os.ErrExist}
+	}
+	return err
+}
+
+// SwapFile uses a conditional write, so that it's safe even without the pack lock
+func (b *s3Backend) SwapFile(name string, old, data []byte) error {
+	header := http.Header{}
+	if old == nil {
+		header.Set("If-None-Match", "*")
+	} else {
+		current, etag, err := b.get(b.prefix + name)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return ErrSwapConflict
+			}
+			return err
+		}
+		if !bytes.Equal(current, old) {
+			return ErrSwapConflict
+		}
+		header.Set("If-Match", etag)
+	}
+	err := b.put(b.prefix+name, data, header)
+	if isPreconditionFailed(err) {
+		return ErrSwapConflict
+	}
+	return err
+}
+
+func (b *s3Backend) RemoveFile(name string) error {
+	err := b.delete(b.prefix + name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (b *s3Backend) ListFiles(prefix string) ([]string, error) {
+	infos, err := b.list(b.prefix+prefix, "/")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, strings.TrimPrefix(info.Name, b.prefix))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// s3Sign adds an AWS signature version 4 Authorization header to req; path and rawQuery must already be encoded
+// as they appear in req's URL
+func s3Sign(req *http.Request, host, path, rawQuery, payloadHash, accessKeyID, secretAccessKey, region string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Host = host
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "authorization" || k == "user-agent" {
+			continue
+		}
+		headers[k] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		rawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretAccessKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Encode percent-encodes everything except the characters which AWS signatures leave unreserved
+func s3Encode(s string, keepSlash bool) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func s3EncodePath(path string) string {
+	return s3Encode(path, true)
+}
+
+// s3CanonicalQuery encodes query with sorted keys, as required for signing
+func s3CanonicalQuery(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Encode(k, false)+"="+s3Encode(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,302 @@
+package pack
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The HTTP protocol served by Server, and spoken by the http backend, maps directly onto Backend:
+//
+//	GET    /objects/              list objects (a JSON array of Info)
+//	HEAD   /objects/<name>        stat an object
+//	GET    /objects/<name>        read an object
+//	PUT    /objects/<name>        store an object; the server rejects it unless its sha1 matches the name
+//	DELETE /objects/<name>        delete an object
+//	GET    /files/?prefix=<p>     list files (a JSON array of names)
+//	HEAD   /files/<name>          stat a file
+//	GET    /files/<name>          read a file
+//	PUT    /files/<name>          write a file; with "If-None-Match: *" it must not exist, and with
+//	                              "If-Match: <sha1>" its current contents must have that sha1 (compare-and-swap)
+//	DELETE /files/<name>          remove a file
+//
+// Locks are ordinary files under locks/. Failed conditions are reported with 412 Precondition Failed, and missing
+// objects and files with 404 Not Found.
+const (
+	httpObjectsPath = "objects/"
+	httpFilesPath   = "files/"
+)
+
+// ServerOptions controls how a pack is served
+type ServerOptions struct {
+	// Token, when set, must be sent by clients as "Authorization: Bearer <token>"
+	Token string
+	// AppendOnly rejects requests which would delete or rewrite history: objects can't be deleted, meta can't be
+	// replaced, the reflog can only be appended to, and refs can only point to stored refs. Only lock files can
+	// be removed.
+	AppendOnly bool
+}
+
+type server struct {
+	b    Backend
+	opts ServerOptions
+	// mu serializes changes to files, so that compare-and-swap is atomic
+	mu sync.Mutex
+}
+
+// NewServer returns a handler which serves the pack stored in b
+func NewServer(b Backend, opts ServerOptions) http.Handler {
+	if opts.AppendOnly {
+		b = newAppendOnlyBackend(b)
+	}
+	return &server{b: b, opts: opts}
+}
+
+// httpStatusError is an error with the status code which it is reported with
+type httpStatusError struct {
+	code int
+	msg  string
+}
+
+func (e *httpStatusError) Error() string {
+	return e.msg
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &httpStatusError{code: http.StatusBadRequest, msg: fmt.Sprintf(format, args...)}
+}
+
+var errPreconditionFailed = &httpStatusError{code: http.StatusPreconditionFailed, msg: "precondition failed"}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Token != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Token)) != 1 {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var err error
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case strings.HasPrefix(p, httpObjectsPath):
+		err = s.serveObject(w, r, p[len(httpObjectsPath):])
+	case strings.HasPrefix(p, httpFilesPath):
+		err = s.serveFile(w, r, p[len(httpFilesPath):])
+	default:
+		err = &httpStatusError{code: http.StatusNotFound, msg: "not found"}
+	}
+	if err != nil {
+		code := http.StatusInternalServerError
+		var se *httpStatusError
+		switch {
+		case errors.As(err, &se):
+			code = se.code
+		case errors.Is(err, os.ErrNotExist):
+			code = http.StatusNotFound
+		case errors.Is(err, os.ErrPermission):
+			code = http.StatusForbidden
+		}
+		if code == http.StatusInternalServerError {
+			fmt.Fprintf(os.Stderr, "%s %s failed: %s\n", r.Method, r.URL.Path, err)
+		}
+		http.Error(w, err.Error(), code)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+func writeInfoHeaders(w http.ResponseWriter, info Info) {
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+}
+
+// checkObjectName allows a sha1, optionally followed by the bkup suffix or a repair suffix
+func checkObjectName(name string) error {
+	if _, ok := objectNameSha1(name); !ok {
+		return badRequest("invalid object name %q", name)
+	}
+	return nil
+}
+
+// checkFileName allows clean relative paths outside the directories which a local pack uses for other purposes
+func checkFileName(name string) error {
+	if name == "" || path.Clean(name) != name || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") ||
+		strings.HasPrefix(name, "data/") || strings.HasPrefix(name, tmpDirName+"/") {
+		return badRequest("invalid file name %q", name)
+	}
+	return nil
+}
+
+func (s *server) serveObject(w http.ResponseWriter, r *http.Request, name string) error {
+	if name == "" {
+		if r.Method != http.MethodGet {
+			return &httpStatusError{code: http.StatusMethodNotAllowed, msg: "method not allowed"}
+		}
+		objects, err := s.b.ListObjects()
+		if err != nil {
+			return err
+		}
+		if objects == nil {
+			objects = []Info{}
+		}
+		return writeJSON(w, objects)
+	}
+	err := checkObjectName(name)
+	if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		info, err := s.b.StatObject(name)
+		if err != nil {
+			return err
+		}
+		writeInfoHeaders(w, info)
+		return nil
+	case http.MethodGet:
+		info, err := s.b.StatObject(name)
+		if err != nil {
+			return err
+		}
+		rc, err := s.b.GetObject(name)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		writeInfoHeaders(w, info)
+		_, err = io.Copy(w, rc)
+		if err != nil {
+			// the status has already been sent; the client sees a short body
+			fmt.Fprintf(os.Stderr, "GET %s failed: %s\n", r.URL.Path, err)
+		}
+		return nil
+	case http.MethodPut:
+		return s.putObject(r.Body, name)
+	case http.MethodDelete:
+		return s.b.DeleteObject(name)
+	}
+	return &httpStatusError{code: http.StatusMethodNotAllowed, msg: "method not allowed"}
+}
+
+// putObject stores an object, unless its contents don't match its name
+func (s *server) putObject(body io.Reader, name string) error {
+	obj, err := s.b.CreateObject()
+	if err != nil {
+		return err
+	}
+	h := sha1.New()
+	_, err = io.Copy(io.MultiWriter(obj, h), body)
+	if err != nil {
+		obj.Abort()
+		return err
+	}
+	actual := fmt.Sprintf("%x", h.Sum(nil))
+	if actual != name[:40] {
+		obj.Abort()
+		return badRequest("%s", &CorruptObjectError{Path: name, Expected: name[:40], Actual: actual})
+	}
+	return obj.Commit(name)
+}
+
+func (s *server) serveFile(w http.ResponseWriter, r *http.Request, name string) error {
+	if name == "" {
+		if r.Method != http.MethodGet {
+			return &httpStatusError{code: http.StatusMethodNotAllowed, msg: "method not allowed"}
+		}
+		prefix := r.URL.Query().Get("prefix")
+		if dir := path.Dir(prefix + "x"); dir != "." && checkFileName(dir) != nil {
+			return badRequest("invalid prefix %q", prefix)
+		}
+		names, err := s.b.ListFiles(prefix)
+		if err != nil {
+			return err
+		}
+		if names == nil {
+			names = []string{}
+		}
+		return writeJSON(w, names)
+	}
+	err := checkFileName(name)
+	if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		info, err := s.b.StatFile(name)
+		if err != nil {
+			return err
+		}
+		writeInfoHeaders(w, info)
+		return nil
+	case http.MethodGet:
+		data, err := s.b.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+		return nil
+	case http.MethodPut:
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxHTTPFileSize+1))
+		if err != nil {
+			return err
+		}
+		if len(data) > maxHTTPFileSize {
+			return &httpStatusError{code: http.StatusRequestEntityTooLarge, msg: "file is too large"}
+		}
+		return s.putFile(name, data, r.Header.Get("If-None-Match") == "*", r.Header.Get("If-Match"))
+	case http.MethodDelete:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.b.RemoveFile(name)
+	}
+	return &httpStatusError{code: http.StatusMethodNotAllowed, msg: "method not allowed"}
+}
+
+// maxHTTPFileSize limits the size of a file (as opposed to an object) which can be uploaded; files are small
+// bookkeeping such as the reflog
+const maxHTTPFileSize = 64 * 1024 * 1024
+
+func (s *server) putFile(name string, data []byte, mustNotExist bool, ifMatch string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.b.ReadFile(name)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		current = nil
+	}
+	if mustNotExist && current != nil {
+		return errPreconditionFailed
+	}
+	if ifMatch != "" && (current == nil || strings.Trim(ifMatch, `"`) != fmt.Sprintf("%x", sha1.Sum(current))) {
+		return errPreconditionFailed
+	}
+	if mustNotExist {
+		err := s.b.CreateFile(name, data)
+		if errors.Is(err, os.ErrExist) {
+			return errPreconditionFailed
+		}
+		return err
+	}
+	return s.b.WriteFile(name, data)
+}
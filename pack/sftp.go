@@ -0,0 +1,513 @@
+package pack
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPConfig describes where (and as whom) an sftp backend stores a pack
+type SFTPConfig struct {
+	User string
+	// Addr is the host:port of the ssh server
+	Addr string
+	// Path is the directory holding the pack; relative paths are relative to the user's home directory
+	Path string
+
+	Auth            []ssh.AuthMethod
+	HostKeyCallback ssh.HostKeyCallback
+}
+
+// sftpBackend stores a pack in a directory on an ssh server, using the same layout as localBackend
+type sftpBackend struct {
+	client *sftp.Client
+	conn   *ssh.Client
+	root   string
+	name   string
+
+	posixRename bool
+	fsync       bool
+
+	// sealed makes objects read-only once they are written
+	sealed bool
+}
+
+// DialSFTP connects to an ssh server and returns a backend which stores a pack in cfg.Path on it
+func DialSFTP(cfg SFTPConfig) (Backend, error) {
+	conn, err := ssh.Dial("tcp", cfg.Addr, &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            cfg.Auth,
+		HostKeyCallback: cfg.HostKeyCallback,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", cfg.Addr, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start sftp on %s: %w", cfg.Addr, err)
+	}
+	b := newSFTPBackend(client, cfg.Path)
+	b.conn = conn
+	b.name = fmt.Sprintf("sftp://%s@%s/%s", cfg.User, cfg.Addr, strings.TrimPrefix(cfg.Path, "/"))
+	if !path.IsAbs(cfg.Path) {
+		b.name = fmt.Sprintf("sftp://%s@%s/~/%s", cfg.User, cfg.Addr, cfg.Path)
+	}
+	return b, nil
+}
+
+// NewSFTPBackend returns a backend which stores a pack in the directory root, using an existing sftp client
+func NewSFTPBackend(client *sftp.Client, root string) Backend {
+	return newSFTPBackend(client, root)
+}
+
+func newSFTPBackend(client *sftp.Client, root string) *sftpBackend {
+	_, posixRename := client.HasExtension("posix-rename@openssh.com")
+	_, fsync := client.HasExtension("fsync@openssh.com")
+	return &sftpBackend{
+		client:      client,
+		root:        root,
+		name:        "sftp:" + root,
+		posixRename: posixRename,
+		fsync:       fsync,
+	}
+}
+
+// newSFTPBackendFromURL parses dst (sftp://user@host[:port]/path, where a path starting with /~/ is relative to
+// the user's home directory) and authenticates with ssh-agent and the user's default keys, checking the host key
+// against ~/.ssh/known_hosts
+func newSFTPBackendFromURL(dst string) (Backend, error) {
+	u, err := url.Parse(dst)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("bad dst %s: no host was given", dst)
+	}
+	user := u.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	root := u.Path
+	if strings.HasPrefix(root, "/~/") {
+		root = root[len("/~/"):]
+	}
+	if root == "" || root == "/" {
+		return nil, fmt.Errorf("bad dst %s: no path was given", dst)
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	knownHostsPath := filepath.Join(home, ".ssh", "known_hosts")
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s (the host key of %s must be listed there): %w", knownHostsPath, u.Hostname(), err)
+	}
+	auth, err := sshAuthMethods(home)
+	if err != nil {
+		return nil, err
+	}
+	return DialSFTP(SFTPConfig{
+		User:            user,
+		Addr:            addr,
+		Path:            root,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	})
+}
+
+// sshAuthMethods returns the keys held by ssh-agent (if SSH_AUTH_SOCK is set) followed by the user's default
+// private keys; keys protected by a passphrase must be added to the agent
+func sshAuthMethods(home string) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to ssh-agent: %w", err)
+		}
+		methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+
+	var signers []ssh.Signer
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		keyPath := filepath.Join(home, ".ssh", name)
+		data, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			var missing *ssh.PassphraseMissingError
+			if errors.As(err, &missing) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to parse %s: %w", keyPath, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no ssh keys were found; start ssh-agent or create %s", filepath.Join(home, ".ssh", "id_ed25519"))
+	}
+	return methods, nil
+}
+
+// Close closes the connection to the server
+func (b *sftpBackend) Close() error {
+	err := b.client.Close()
+	if b.conn != nil {
+		connErr := b.conn.Close()
+		if err == nil {
+			err = connErr
+		}
+	}
+	return err
+}
+
+func (b *sftpBackend) sealObjects() {
+	b.sealed = true
+}
+
+func (b *sftpBackend) String() string {
+	return b.name
+}
+
+func (b *sftpBackend) objectPath(name string) (string, error) {
+	if len(name) < 40 || !isSha1(name[:40]) {
+		return "", fmt.Errorf("invalid object name %q", name)
+	}
+	return path.Join(b.root, "data", name[0:2], name[2:4], name), nil
+}
+
+func (b *sftpBackend) ObjectLocation(name string) string {
+	p, err := b.objectPath(name)
+	if err != nil {
+		return name
+	}
+	return p
+}
+
+func (b *sftpBackend) filePath(name string) string {
+	return path.Join(b.root, name)
+}
+
+// sftpPathError adds the path to errors from the sftp client, which don't include it
+func sftpPathError(op, p string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &os.PathError{Op: op, Path: p, Err: err}
+}
+
+// rename replaces dst with src; servers without the posix-rename extension can't do so atomically, so dst is
+// removed first
+func (b *sftpBackend) rename(src, dst string) error {
+	if b.posixRename {
+		return sftpPathError("rename", dst, b.client.PosixRename(src, dst))
+	}
+	err := b.client.Remove(dst)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return sftpPathError("remove", dst, err)
+	}
+	return sftpPathError("rename", dst, b.client.Rename(src, dst))
+}
+
+// createTemp creates a file under tmp/ which is renamed into place once it has been written
+func (b *sftpBackend) createTemp() (*sftp.File, string, error) {
+	tmpDir := b.filePath(tmpDirName)
+	err := b.client.MkdirAll(tmpDir)
+	if err != nil {
+		return nil, "", sftpPathError("mkdir", tmpDir, err)
+	}
+	r := make([]byte, 8)
+	_, err = rand.Read(r)
+	if err != nil {
+		return nil, "", err
+	}
+	tmp := path.Join(tmpDir, hex.EncodeToString(r))
+	f, err := b.client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return nil, "", sftpPathError("create", tmp, err)
+	}
+	return f, tmp, nil
+}
+
+// closeTemp syncs (when the server supports it) and closes a temporary file before it is renamed into place
+func (b *sftpBackend) closeTemp(f *sftp.File, tmp string) error {
+	var err error
+	if b.fsync {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return sftpPathError("write", tmp, err)
+}
+
+// commitTemp moves a temporary file to dst, creating dst's directory if needed
+func (b *sftpBackend) commitTemp(f *sftp.File, tmp, dst string) error {
+	err := b.closeTemp(f, tmp)
+	if err == nil {
+		err = sftpPathError("mkdir", path.Dir(dst), b.client.MkdirAll(path.Dir(dst)))
+	}
+	if err == nil {
+		err = b.rename(tmp, dst)
+	}
+	if err != nil {
+		b.client.Remove(tmp)
+	}
+	return err
+}
+
+type sftpObjectWriter struct {
+	f   *sftp.File
+	tmp string
+	b   *sftpBackend
+}
+
+func (w *sftpObjectWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+func (w *sftpObjectWriter) Commit(name string) error {
+	dst, err := w.b.objectPath(name)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	if w.b.sealed {
+		err = w.f.Chmod(0400)
+		if err != nil {
+			w.Abort()
+			return sftpPathError("chmod", w.tmp, err)
+		}
+	}
+	return w.b.commitTemp(w.f, w.tmp, dst)
+}
+
+func (w *sftpObjectWriter) Abort() {
+	w.f.Close()
+	w.b.client.Remove(w.tmp)
+}
+
+func (b *sftpBackend) CreateObject() (ObjectWriter, error) {
+	f, tmp, err := b.createTemp()
+	if err != nil {
+		return nil, err
+	}
+	return &sftpObjectWriter{f: f, tmp: tmp, b: b}, nil
+}
+
+func (b *sftpBackend) GetObject(name string) (io.ReadCloser, error) {
+	p, err := b.objectPath(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := b.client.Open(p)
+	if err != nil {
+		return nil, sftpPathError("open", p, err)
+	}
+	return f, nil
+}
+
+func (b *sftpBackend) stat(name, p string) (Info, error) {
+	info, err := b.client.Stat(p)
+	if err != nil {
+		return Info{}, sftpPathError("stat", p, err)
+	}
+	if info.IsDir() {
+		return Info{}, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+	return Info{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (b *sftpBackend) StatObject(name string) (Info, error) {
+	p, err := b.objectPath(name)
+	if err != nil {
+		return Info{}, err
+	}
+	return b.stat(name, p)
+}
+
+func (b *sftpBackend) ListObjects() ([]Info, error) {
+	dataRoot := b.filePath("data")
+	var objects []Info
+	walker := b.client.Walk(dataRoot)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if errors.Is(err, os.ErrNotExist) && walker.Path() == dataRoot {
+				return nil, nil
+			}
+			return nil, sftpPathError("walk", walker.Path(), err)
+		}
+		info := walker.Stat()
+		if info.IsDir() {
+			continue
+		}
+		name := path.Base(walker.Path())
+		if p, err := b.objectPath(name); err != nil || p != walker.Path() {
+			fmt.Fprintf(os.Stderr, "ignoring unexpected file %s\n", walker.Path())
+			continue
+		}
+		objects = append(objects, Info{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return objects, nil
+}
+
+func (b *sftpBackend) DeleteObject(name string) error {
+	p, err := b.objectPath(name)
+	if err != nil {
+		return err
+	}
+	return sftpPathError("remove", p, b.client.Remove(p))
+}
+
+func (b *sftpBackend) ReadFile(name string) ([]byte, error) {
+	p := b.filePath(name)
+	f, err := b.client.Open(p)
+	if err != nil {
+		return nil, sftpPathError("open", p, err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, sftpPathError("read", p, err)
+	}
+	return data, nil
+}
+
+func (b *sftpBackend) StatFile(name string) (Info, error) {
+	return b.stat(name, b.filePath(name))
+}
+
+func (b *sftpBackend) WriteFile(name string, data []byte) error {
+	f, tmp, err := b.createTemp()
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		b.client.Remove(tmp)
+		return sftpPathError("write", tmp, err)
+	}
+	return b.commitTemp(f, tmp, b.filePath(name))
+}
+
+func (b *sftpBackend) CreateFile(name string, data []byte) error {
+	p := b.filePath(name)
+	err := b.client.MkdirAll(path.Dir(p))
+	if err != nil {
+		return sftpPathError("mkdir", path.Dir(p), err)
+	}
+	f, err := b.client.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		// sftp (version 3) has no status code for an existing file
+		if _, statErr := b.client.Stat(p); statErr == nil {
+			return &os.PathError{Op: "create", Path: p, Err: os.ErrExist}
+		}
+		return sftpPathError("create", p, err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = b.closeTemp(f, p)
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		b.client.Remove(p)
+		return sftpPathError("write", p, err)
+	}
+	return nil
+}
+
+// SwapFile relies on the pack lock to keep other processes from writing between the comparison and the write
+func (b *sftpBackend) SwapFile(name string, old, data []byte) error {
+	current, err := b.ReadFile(name)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		current = nil
+	}
+	if (old == nil) != (current == nil) || !bytes.Equal(old, current) {
+		return ErrSwapConflict
+	}
+	return b.WriteFile(name, data)
+}
+
+func (b *sftpBackend) RemoveFile(name string) error {
+	p := b.filePath(name)
+	err := b.client.Remove(p)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return sftpPathError("remove", p, err)
+	}
+	return nil
+}
+
+func (b *sftpBackend) ListFiles(prefix string) ([]string, error) {
+	dir, base := path.Split(prefix)
+	entries, err := b.client.ReadDir(b.filePath(dir))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, sftpPathError("readdir", b.filePath(dir), err)
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), base) {
+			names = append(names, dir+e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// cleanTemp removes temporary files abandoned by an interrupted run
+func (b *sftpBackend) cleanTemp() error {
+	tmpDir := b.filePath(tmpDirName)
+	entries, err := b.client.ReadDir(tmpDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return sftpPathError("readdir", tmpDir, err)
+	}
+	for _, e := range entries {
+		p := path.Join(tmpDir, e.Name())
+		err := b.client.Remove(p)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return sftpPathError("remove", p, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package pack
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// newTestSFTPClient returns a client connected (without ssh) to an in-process sftp server
+func newTestSFTPClient(t *testing.T) *sftp.Client {
+	serverConn, clientConn := net.Pipe()
+	server, err := sftp.NewServer(serverConn)
+	assert.Nil(t, err)
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client
+}
+
+func TestSFTPBackend(t *testing.T) {
+	root := t.TempDir()
+	b := NewSFTPBackend(newTestSFTPClient(t), root)
+	testBackend(t, b)
+	_, err := os.Stat(filepath.Join(root, "data", "f5", "72", "f572d396fae9206628714fb2ce00f72e94f2258f"))
+	assert.Nil(t, err, "objects should be stored under data/xx/yy/")
+
+	// a pack written over sftp can be read locally, and vice versa
+	root = t.TempDir()
+	b = NewSFTPBackend(newTestSFTPClient(t), root)
+	testBackendPack(t, b, b)
+	p, err := New(NewLocalBackend(root), Options{ReadOnly: true, ParityBits: 1})
+	assert.Nil(t, err)
+	assert.True(t, verifyPack(t, p))
+	assert.Nil(t, p.Close())
+}
+
+func TestSFTPCleanTemp(t *testing.T) {
+	root := t.TempDir()
+	b := NewSFTPBackend(newTestSFTPClient(t), root)
+	w, err := b.CreateObject()
+	assert.Nil(t, err)
+	_, err = w.Write([]byte("abandoned"))
+	assert.Nil(t, err)
+
+	_, err = Init(b, 1, false)
+	assert.Nil(t, err)
+	p, err := New(b, Options{ParityBits: 1})
+	assert.Nil(t, err)
+	entries, err := ioutil.ReadDir(filepath.Join(root, tmpDirName))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 0)
+	assert.Nil(t, p.Close())
+}
+
+// serveTestSSH runs an ssh server which accepts authorizedKey and serves sftp; it returns the server's address
+func serveTestSSH(t *testing.T, hostKey ssh.Signer, authorizedKey ssh.PublicKey) string {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "backup" && string(key.Marshal()) == string(authorizedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	config.AddHostKey(hostKey)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSSHConn(c, config)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func serveTestSSHConn(c net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		c.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel)
+					if err == nil {
+						server.Serve()
+					}
+					channel.Close()
+				}
+			}
+		}()
+	}
+}
+
+// serveTestAgent runs an ssh-agent holding key; it returns the agent's socket
+func serveTestAgent(t *testing.T, key interface{}) string {
+	keyring := agent.NewKeyring()
+	assert.Nil(t, keyring.Add(agent.AddedKey{PrivateKey: key}))
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", sock)
+	assert.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, c)
+		}
+	}()
+	return sock
+}
+
+func TestSFTPDial(t *testing.T) {
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	hostKey, err := ssh.NewSignerFromKey(hostPriv)
+	assert.Nil(t, err)
+	userPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	userKey, err := ssh.NewSignerFromKey(userPriv)
+	assert.Nil(t, err)
+	addr := serveTestSSH(t, hostKey, userKey.PublicKey())
+	agentSock := serveTestAgent(t, userPriv)
+
+	for _, tc := range []struct {
+		name    string
+		keyFile bool
+		agent   bool
+		ok      bool
+	}{
+		{name: "key file", keyFile: true, ok: true},
+		{name: "agent", agent: true, ok: true},
+		{name: "no keys"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			home := t.TempDir()
+			t.Setenv("HOME", home)
+			sshDir := filepath.Join(home, ".ssh")
+			assert.Nil(t, os.Mkdir(sshDir, 0700))
+			knownHost := knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostKey.PublicKey())
+			assert.Nil(t, ioutil.WriteFile(filepath.Join(sshDir, "known_hosts"), []byte(knownHost+"\n"), 0600))
+			if tc.keyFile {
+				der, err := x509.MarshalECPrivateKey(userPriv)
+				assert.Nil(t, err)
+				data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+				assert.Nil(t, ioutil.WriteFile(filepath.Join(sshDir, "id_ecdsa"), data, 0600))
+			}
+			t.Setenv("SSH_AUTH_SOCK", "")
+			if tc.agent {
+				t.Setenv("SSH_AUTH_SOCK", agentSock)
+			}
+
+			root := t.TempDir()
+			b, err := OpenBackend("sftp://backup@" + addr + root)
+			if !tc.ok {
+				assert.NotNil(t, err)
+				return
+			}
+			if !assert.Nil(t, err) {
+				return
+			}
+			defer CloseBackend(b)
+			assert.Equal(t, "sftp://backup@"+addr+root, b.String())
+
+			_, err = Init(b, 1, false)
+			assert.Nil(t, err)
+			p, err := New(b, Options{ParityBits: 1})
+			assert.Nil(t, err)
+			assert.Nil(t, p.AddFile(context.Background(), filepath.Join(sshDir, "known_hosts"), "/known_hosts"))
+			assert.Nil(t, p.Close())
+			p, err = New(NewLocalBackend(root), Options{ReadOnly: true, ParityBits: 1})
+			assert.Nil(t, err)
+			files, err := p.List()
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"/known_hosts"}, files)
+			assert.Nil(t, p.Close())
+		})
+	}
+}
+
+func TestSFTPUnknownHost(t *testing.T) {
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	hostKey, err := ssh.NewSignerFromKey(hostPriv)
+	assert.Nil(t, err)
+	userPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	userKey, err := ssh.NewSignerFromKey(userPriv)
+	assert.Nil(t, err)
+	addr := serveTestSSH(t, hostKey, userKey.PublicKey())
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", serveTestAgent(t, userPriv))
+	assert.Nil(t, os.Mkdir(filepath.Join(home, ".ssh"), 0700))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(home, ".ssh", "known_hosts"), nil, 0600))
+	_, err = OpenBackend("sftp://backup@" + addr + t.TempDir())
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "key is unknown")
+	}
+}
@@ -0,0 +1,320 @@
+package pack
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// SyncOptions control how Sync brings one pack up to date from another
+type SyncOptions struct {
+	// DryRun only works out what would be transferred
+	DryRun bool
+}
+
+// SyncStats summarizes what Sync transferred (or, in a dry run, would transfer)
+type SyncStats struct {
+	// Snapshots is the number of snapshots which the destination was missing
+	Snapshots int
+	// Objects and Bytes count the objects which the destination was missing
+	Objects int
+	Bytes   int64
+	// Skipped counts the snapshots which couldn't be copied, because their refs or an object they reference is
+	// missing (or, for refs, corrupt) in the source
+	Skipped int
+	// Merged is set if the head of the destination had diverged from the source's, so that the refs pointer was moved
+	// to a new snapshot merging the files of both; otherwise its history was fast-forwarded (if anything was missing)
+	Merged bool
+}
+
+// Sync copies the snapshots which the pack in to is missing from the pack in from, along with every object they
+// reference which to doesn't already have; objects are verified as they are copied, and read from any intact copy
+// in from. The reflogs of the two packs are then merged, and to's refs pointer is moved to from's head, or (if to's
+// head has diverged from it) to a new snapshot merging the two.
+func Sync(ctx context.Context, from, to Backend, opts SyncOptions) (SyncStats, error) {
+	var stats SyncStats
+	src, err := openForSync(from, true)
+	if err != nil {
+		return stats, err
+	}
+	defer src.Abort()
+	dst, err := openForSync(to, opts.DryRun)
+	if err != nil {
+		return stats, err
+	}
+	defer dst.Abort()
+
+	srcEntries, _, err := readReflog(src.backend)
+	if err != nil {
+		return stats, err
+	}
+	dstEntries, _, err := readReflog(dst.backend)
+	if err != nil {
+		return stats, err
+	}
+	// a snapshot is matched by its id alone, as the same one may have been recorded at a different time
+	var missing []reflogEntry
+	for _, e := range srcEntries {
+		if !containsSnapshot(dstEntries, e.sha1) {
+			missing = append(missing, e)
+		}
+	}
+	dstHistory := dstEntries
+
+	// work out which objects are missing; data is copied before refs, so that an interrupted sync never leaves refs
+	// whose data is missing
+	var data, refsObjects []string
+	seen := map[string]bool{}
+	for _, e := range missing {
+		err := ctx.Err()
+		if err != nil {
+			return stats, err
+		}
+		intact, err := intactCopies(src.backend, e.sha1)
+		if err != nil {
+			return stats, err
+		}
+		if len(intact) == 0 {
+			fmt.Fprintf(os.Stderr, "WARNING: skipping snapshot %s from %s: no intact copy of its refs exists\n", e.sha1, e.time.Format(time.RFC3339))
+			stats.Skipped++
+			continue
+		}
+		refs, err := readRefsObject(src.backend, intact[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: skipping snapshot %s from %s: %s\n", e.sha1, e.time.Format(time.RFC3339), err)
+			stats.Skipped++
+			continue
+		}
+		shas := []string{e.sha1}
+		for _, ref := range refs {
+			shas = append(shas, ref.sha1)
+		}
+
+		// the snapshot is only copied if every object it needs can be, so that a sync never fails part way
+		var snapshotData, snapshotRefs []string
+		var sizes []int64
+		var missingErr error
+		planned := map[string]bool{}
+		for i, sha := range shas {
+			if seen[sha] || planned[sha] {
+				continue
+			}
+			planned[sha] = true
+			ok, err := objectExists(dst.backend, sha)
+			if err != nil {
+				return stats, err
+			}
+			if ok {
+				continue
+			}
+			names, err := objectCopies(src.backend, sha)
+			if err != nil {
+				return stats, err
+			}
+			if len(names) == 0 {
+				missingErr = fmt.Errorf("%s is missing", src.backend.ObjectLocation(sha))
+				break
+			}
+			info, err := src.backend.StatObject(names[0])
+			if err != nil {
+				return stats, err
+			}
+			if i == 0 {
+				snapshotRefs = append(snapshotRefs, sha)
+			} else {
+				snapshotData = append(snapshotData, sha)
+			}
+			sizes = append(sizes, info.Size)
+		}
+		if missingErr != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: skipping snapshot %s from %s: %s\n", e.sha1, e.time.Format(time.RFC3339), missingErr)
+			stats.Skipped++
+			continue
+		}
+
+		stats.Snapshots++
+		dstEntries = append(dstEntries, e)
+		for sha := range planned {
+			seen[sha] = true
+		}
+		data = append(data, snapshotData...)
+		refsObjects = append(refsObjects, snapshotRefs...)
+		stats.Objects += len(sizes)
+		for _, size := range sizes {
+			stats.Bytes += size
+		}
+	}
+
+	// the newest snapshot of src which dst has once it's synced (src's head, unless that was skipped)
+	var srcHead string
+	for i := len(srcEntries) - 1; i >= 0 && srcHead == ""; i-- {
+		if containsSnapshot(dstEntries, srcEntries[i].sha1) {
+			srcHead = srcEntries[i].sha1
+		}
+	}
+	head := headAfterMerge(dst.head, srcHead, dstHistory, srcEntries)
+	stats.Merged = head == ""
+	if opts.DryRun || stats.Snapshots == 0 {
+		return stats, nil
+	}
+
+	for _, sha := range append(data, refsObjects...) {
+		err := ctx.Err()
+		if err != nil {
+			return stats, err
+		}
+		err = syncObject(src.backend, dst.backend, sha, sha)
+		if err != nil {
+			return stats, err
+		}
+		if dst.parityBits == 1 {
+			err = dst.createBkup(sha)
+			if err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	return stats, dst.mergeReflog(dstEntries, head, srcHead)
+}
+
+// headAfterMerge works out which snapshot the refs pointer of a pack should point at once it has the snapshots of
+// another pack, whose head is srcHead: srcHead if the pack's own head is in the other's history (srcHistory) or it has
+// none, and its own head if srcHead already was in its history (dstHistory). Otherwise the two heads have diverged,
+// each having files which the other may lack, and "" is returned.
+func headAfterMerge(dstHead, srcHead string, dstHistory, srcHistory []reflogEntry) string {
+	switch {
+	case dstHead == "" || containsSnapshot(srcHistory, dstHead):
+		return srcHead
+	case srcHead == "" || containsSnapshot(dstHistory, srcHead):
+		return dstHead
+	}
+	return ""
+}
+
+// mergeReflog replaces the reflog of p with entries (which must include p's own), and moves the refs pointer to head.
+// A head of "" means that p's head diverged from srcHead; the pointer is then moved to a new snapshot holding the
+// files of both (srcHead's winning where both have a file at the same path), which is recorded in the reflog too.
+func (p *packImp) mergeReflog(entries []reflogEntry, head, srcHead string) error {
+	if head == "" {
+		merged, err := p.mergeSnapshots(srcHead)
+		if err != nil {
+			return fmt.Errorf("%s has diverged from snapshot %s, and can't be merged with it: %w", p.backend, srcHead, err)
+		}
+		entries = append(entries, reflogEntry{sha1: merged, time: time.Now()})
+		head = merged
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].time.Before(entries[j].time)
+	})
+	err := writeReflog(p.backend, entries)
+	if err != nil {
+		return err
+	}
+	if head == p.head {
+		return nil
+	}
+	return p.writeRefsPointer(head)
+}
+
+// mergeSnapshots stores a snapshot holding the files of both p's head and srcHead (which p must have), taking
+// srcHead's where both have a file at the same path, and returns its sha1
+func (p *packImp) mergeSnapshots(srcHead string) (string, error) {
+	srcRefs, err := readSnapshotRefs(p.backend, srcHead)
+	if err != nil {
+		return "", err
+	}
+	dstRefs, err := readSnapshotRefs(p.backend, p.head)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(os.Stderr, "merging snapshot %s into %s\n", srcHead, p.head)
+	merged := append([]*refEntry{}, srcRefs...)
+	paths := map[string]bool{}
+	for _, ref := range srcRefs {
+		paths[ref.path] = true
+	}
+	for _, ref := range dstRefs {
+		if !paths[ref.path] {
+			merged = append(merged, ref)
+		}
+	}
+	return p.storeRefs(merged)
+}
+
+// openForSync opens a pack using the parity it was created with
+func openForSync(b Backend, readOnly bool) (*packImp, error) {
+	meta, err := readMeta(b)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%s: %w", b, errNoPack)
+		}
+		return nil, err
+	}
+	p, err := New(b, Options{ReadOnly: readOnly, ParityBits: meta.parityBits})
+	if err != nil {
+		return nil, err
+	}
+	return p.(*packImp), nil
+}
+
+// OpenReadOnly opens the pack in b read-only, using the parity it was created with (so it needs no config)
+func OpenReadOnly(b Backend) (Pack, error) {
+	p, err := openForSync(b, true)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// syncObject copies an object from one pack to another (where it's stored as dstName), trying each copy in src until
+// one is intact
+func syncObject(src, dst Backend, sha1, dstName string) error {
+	names, err := objectCopies(src, sha1)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("%s: %w", src.ObjectLocation(sha1), os.ErrNotExist)
+	}
+	for _, name := range names {
+		err = copyVerified(src, dst, name, sha1, dstName)
+		if !errors.Is(err, ErrCorruptObject) {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "WARNING: %s\n", err)
+	}
+	return err
+}
+
+// copyVerified copies the named object from src to dstName in dst, only committing it if its contents match
+// expectedSha1
+func copyVerified(src, dst Backend, name, expectedSha1, dstName string) error {
+	fmt.Fprintf(os.Stderr, "copying %s -> %s\n", src.ObjectLocation(name), dst.ObjectLocation(dstName))
+	r, err := src.GetObject(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := dst.CreateObject()
+	if err != nil {
+		return err
+	}
+	h := sha1.New()
+	_, err = io.Copy(io.MultiWriter(w, h), r)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	actual := fmt.Sprintf("%x", h.Sum(nil))
+	if actual != expectedSha1 {
+		w.Abort()
+		return &CorruptObjectError{Path: src.ObjectLocation(name), Expected: expectedSha1, Actual: actual}
+	}
+	return w.Commit(dstName)
+}